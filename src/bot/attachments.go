@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"dca"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+	"github.com/dustin/go-humanize"
+)
+
+// Uploads we're willing to play
+var attachmentExts = map[string]bool{
+	".mp3":  true,
+	".ogg":  true,
+	".wav":  true,
+	".flac": true,
+}
+
+// Downloaded attachments live in audio/ under this prefix until their play is
+// done with, or the next restart if we go down first
+const attachmentPrefix = "att_"
+
+// First audio attachment on m, nil if there isn't one
+func audioAttachment(m *discordgo.MessageCreate) *discordgo.MessageAttachment {
+	for _, a := range m.Attachments {
+		if attachmentExts[strings.ToLower(filepath.Ext(a.Filename))] {
+			return a
+		}
+	}
+	return nil
+}
+
+// Length of an audio file according to ffprobe
+func probeDuration(file string) (time.Duration, error) {
+	out, err := commandOutput(context.Background(), "ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", file)
+	if err != nil {
+		return 0, err
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// Downloads a into audio/ and checks it's within the size and length limits.
+// Returns the file name inside audio/ and how long it is.
+func downloadAttachment(a *discordgo.MessageAttachment) (string, time.Duration, error) {
+	if ATTACHMENTMAXBYTES > 0 && a.Size > ATTACHMENTMAXBYTES {
+		return "", 0, fmt.Errorf("file is bigger than %s", humanize.Bytes(uint64(ATTACHMENTMAXBYTES)))
+	}
+
+	res, err := http.Get(a.URL)
+	if err != nil {
+		return "", 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("download failed: %s", res.Status)
+	}
+
+	name := attachmentPrefix + a.ID + strings.ToLower(filepath.Ext(a.Filename))
+	file, err := os.Create("audio/" + name)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// Don't trust the size Discord told us
+	var body io.Reader = res.Body
+	if ATTACHMENTMAXBYTES > 0 {
+		body = io.LimitReader(res.Body, int64(ATTACHMENTMAXBYTES)+1)
+	}
+	n, err := io.Copy(file, body)
+	file.Close()
+	if err == nil && ATTACHMENTMAXBYTES > 0 && n > int64(ATTACHMENTMAXBYTES) {
+		err = fmt.Errorf("file is bigger than %s", humanize.Bytes(uint64(ATTACHMENTMAXBYTES)))
+	}
+	if err != nil {
+		os.Remove("audio/" + name)
+		return "", 0, err
+	}
+
+	duration, err := probeDuration("audio/" + name)
+	if err != nil {
+		os.Remove("audio/" + name)
+		log.Println("ffprobe err:", err)
+		return "", 0, errors.New("couldn't read the audio")
+	}
+	if ATTACHMENTMAXLENGTH > 0 && duration > ATTACHMENTMAXLENGTH {
+		os.Remove("audio/" + name)
+		return "", 0, errors.New("audio is longer than " + durationFormat(ATTACHMENTMAXLENGTH))
+	}
+	return name, duration, nil
+}
+
+// Queues the audio file attached to m
+func playAttachment(s *discordgo.Session, m *discordgo.MessageCreate, g *discordgo.Guild) {
+	a := audioAttachment(m)
+	if a == nil {
+		s.ChannelMessageSend(m.ChannelID, "Attach an mp3, ogg, wav or flac file to play it")
+		return
+	}
+
+	name, duration, err := downloadAttachment(a)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error())
+		return
+	}
+
+	play := createPlay(m.Author, g, createEmptySC(), createSound(name+"@file", 1, 250))
+	if play == nil {
+		os.Remove("audio/" + name)
+		s.ChannelMessageSend(m.ChannelID, "Join a voice channel to play "+a.Filename)
+		return
+	}
+	play.TextChannelID = m.ChannelID
+	play.Title = a.Filename
+	play.Duration = duration
+
+	s.ChannelMessageSend(m.ChannelID, "Queued: "+a.Filename)
+	go queuePlay(play, s)
+}
+
+// Saves the audio file attached to m as a tag
+func tagAttachment(s *discordgo.Session, m *discordgo.MessageCreate, g *discordgo.Guild, tag string) {
+	tagDCA := "tag_" + tag + ".dca"
+	if fileExists(tagDCA) {
+		s.ChannelMessageSend(m.ChannelID, tag+" already exists")
+		return
+	}
+
+	a := audioAttachment(m)
+	if a == nil {
+		s.ChannelMessageSend(m.ChannelID, "Attach an mp3, ogg, wav or flac file to make a tag out of it")
+		return
+	}
+
+	name, _, err := downloadAttachment(a)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, "Failed to create tag, error: "+err.Error())
+		return
+	}
+	defer os.Remove("audio/" + name)
+
+	s.ChannelMessageSend(m.ChannelID, "Encoding tag: "+tag)
+	meta := newDCAMetadata(a.Filename, "file", a.URL, m.Author.Username)
+	if result := encodeFile("audio/"+name, tagDCA, meta, getPlayer(g.ID).Settings().Normalize); result != SUCCESS {
+		s.ChannelMessageSend(m.ChannelID, "Failed to create tag, error: "+result)
+	} else {
+		s.ChannelMessageSend(m.ChannelID, tag+" created")
+	}
+}
+
+// Encodes a local file into audio/dcaName, normalizing it first if asked to
+func encodeFile(src, dcaName string, meta *dca.Metadata, normalize bool) string {
+	if normalize {
+		return normalizedEncode(src, dcaName, meta)
+	}
+
+	p := newPipeline(context.Background())
+	p.add("ffmpeg", "-i", src, "-f", "s16le", "-ar", "48000", "-ac", "2", "pipe:1")
+	p.encoded()
+	if err := p.saveTo("audio/"+dcaName, meta); err != nil {
+		log.Println("encode err:", err)
+		return stageError(err)
+	}
+	return SUCCESS
+}
+
+// Deletes the downloaded attachments behind plays that are leaving the player
+// for good
+func discardAttachments(plays []*Play) {
+	for _, play := range plays {
+		if play == nil || play.Sound == nil {
+			continue
+		}
+		name := strings.TrimSuffix(play.Sound.Name, "@file")
+		if name != play.Sound.Name && strings.HasPrefix(name, attachmentPrefix) {
+			os.Remove("audio/" + name)
+		}
+	}
+}
+
+// Removes attachments downloaded before the last restart
+func cleanAttachments() {
+	files, err := ioutil.ReadDir("audio")
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), attachmentPrefix) {
+			os.Remove("audio/" + f.Name())
+		}
+	}
+}
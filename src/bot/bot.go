@@ -3,7 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"encoding/binary"
+	"context"
 	"encoding/csv"
 	"errors"
 	"flag"
@@ -18,9 +18,12 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"text/tabwriter"
 	"time"
 
+	"dca"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/bwmarrin/discordgo"
 	"github.com/dustin/go-humanize"
@@ -34,22 +37,57 @@ var (
 	// Redis client connection (used for stats)
 	rcli *redis.Client
 
-	// Map of Guild id's to *Play channels, used for queuing and rate-limiting guilds
-	queues  = make(map[string]chan *Play)
-	skipped = make(map[string]bool)
-	caching = make(map[string]bool)
-
-	// gifPosting toggle for gifPost
-	gifPosting  = make(map[string]bool)
-	memeTimeout = make(map[string]time.Duration)
-	lastMeme    = make(map[string]time.Time)
-	memeVoice   = make(map[string]bool)
-
 	// BITRATE - Bitrate
 	BITRATE = 128
+	// PIPESTARTTIMEOUT - How long a pipeline gets to produce its first output
+	PIPESTARTTIMEOUT = time.Minute
+	// PIPEIDLETIMEOUT - How long a pipeline's output can stall before it's killed
+	PIPEIDLETIMEOUT = 30 * time.Second
+	// ENCODER - What turns PCM into dca, "gopus" or the path to a dca binary
+	ENCODER = "gopus"
 	// MAXQSIZE - Max queue size
 	MAXQSIZE = 9999
 
+	// PREFETCHBYTES - Most a guild buffers of the next stream while the current one plays
+	PREFETCHBYTES = 4 << 20
+	// PREFETCHAHEAD - How long before the end of a play to start prefetching the next
+	PREFETCHAHEAD = 30 * time.Second
+
+	// PAUSETIMEOUT - How long a guild can stay paused, 0 for forever
+	PAUSETIMEOUT = 10 * time.Minute
+	// PAUSERESUME - Resume instead of leaving the channel when a pause times
+	// out, the queue is kept either way
+	PAUSERESUME = false
+
+	// ATTACHMENTMAXBYTES - Biggest upload that gets played, 0 for no limit
+	ATTACHMENTMAXBYTES = 8 << 20
+	// ATTACHMENTMAXLENGTH - Longest upload that gets played, 0 for no limit
+	ATTACHMENTMAXLENGTH = 15 * time.Minute
+
+	// CACHEBYTES - Memory kept for recently played short sounds, 0 to read everything off disk
+	CACHEBYTES = 16 << 20
+	// CACHECLIPBYTES - Biggest sound file that gets cached, bigger ones are read off disk as they play
+	CACHECLIPBYTES = 512 << 10
+
+	// RECORDLENGTH - How much voice a guild with recording on keeps for clip
+	RECORDLENGTH = 30 * time.Second
+
+	// JITTERDEPTH - How much of a pipe gets buffered before playing it
+	JITTERDEPTH = 3 * time.Second
+	// STREAMRETRIES - How many times a play that drops early gets picked back up
+	STREAMRETRIES = 3
+
+	// AUDIOCHECK - Check audio/ for broken files at startup
+	AUDIOCHECK = true
+	// AUDIOREPAIR - Truncate or quarantine the broken files the startup check
+	// finds, otherwise they're only reported
+	AUDIOREPAIR = true
+
+	// FAILLIMIT - How many times a link can fail to play before it stops getting retried
+	FAILLIMIT = 3
+	// FAILMEMORY - How long a link failing to play is remembered for
+	FAILMEMORY = time.Hour
+
 	// YTAPIKEY - Youtube API Key
 	YTAPIKEY string
 
@@ -60,6 +98,9 @@ var (
 const (
 	// SUCCESS - success
 	SUCCESS = "success"
+
+	// FRAMEDURATION - Length of audio in a single dca frame
+	FRAMEDURATION = 20 * time.Millisecond
 )
 
 // Play represents an individual use of the !airhorn command
@@ -74,6 +115,32 @@ type Play struct {
 
 	// If true, this was a forced play using a specific airhorn sound name
 	Forced bool
+
+	// Text channel the play was requested from, failures get reported there
+	TextChannelID string
+
+	// What lq shows for this play, Title and Duration may be empty if we
+	// couldn't look them up
+	Title    string
+	Link     string
+	UserName string
+	Duration time.Duration
+	Queued   time.Time
+
+	// Set when the play couldn't be played last time round, so repeat
+	// modes leave it be instead of trying it forever
+	failed bool
+}
+
+// Name to show for this play in the queue
+func (p *Play) title() string {
+	if p.Title != "" {
+		return p.Title
+	}
+	if p.Link != "" {
+		return p.Link
+	}
+	return p.Sound.Name
 }
 
 // SoundCollection - Collection of sounds
@@ -96,8 +163,8 @@ type Sound struct {
 	// Delay (in milliseconds) for the bot to wait before sending the disconnect request
 	PartDelay int
 
-	// Buffer to store encoded PCM packets
-	buffer [][]byte
+	// File the sound plays from, sounds outside a collection play audio/Name
+	path string
 }
 
 // AIRHORN - Array of all the sounds we have
@@ -312,15 +379,18 @@ func createSound(Name string, Weight int, PartDelay int) *Sound {
 		Name:      Name,
 		Weight:    Weight,
 		PartDelay: PartDelay,
-		buffer:    make([][]byte, 0),
 	}
 }
 
-// Load entire collection
-func (sc *SoundCollection) Load() {
+// Init - Points the collection's sounds at their files and sets up the weights.
+// Nothing gets loaded, sounds are read as they play.
+func (sc *SoundCollection) Init() {
 	for _, sound := range sc.Sounds {
 		sc.soundRange += sound.Weight
-		sound.Load(sc)
+		sound.path = fmt.Sprintf("audio/%v_%v.dca", sc.Prefix, sound.Name)
+		if _, err := os.Stat(sound.path); err != nil {
+			fmt.Println("error opening dca file :", err)
+		}
 	}
 }
 
@@ -341,288 +411,321 @@ func (sc *SoundCollection) Random() *Sound {
 	return nil
 }
 
-// LoadNow - Modification of Load
-func (s *Sound) LoadNow() error {
-	path := fmt.Sprintf("audio/%v", s.Name)
-	file, err := os.Open(path)
+// File this sound plays from
+func (s *Sound) file() string {
+	if s.path != "" {
+		return s.path
+	}
+	return "audio/" + s.Name
+}
+
+// How long the sound plays for, 0 if it can't be read
+func (s *Sound) duration() time.Duration {
+	if frames, err := sounds.peek(s.file()); err == nil && frames != nil {
+		return time.Duration(len(frames)) * FRAMEDURATION
+	}
+	if frames, err := dcaFrameCount(s.file()); err == nil {
+		return time.Duration(frames) * FRAMEDURATION
+	}
+	return 0
+}
 
+// Reads every frame of a dca file into memory, leaving out any damaged ones
+func loadFrames(path string) ([][]byte, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		fmt.Println("error opening dca file :", err)
-		return err
+		return nil, err
 	}
+	defer file.Close()
 
-	var opuslen int16
+	dr, err := dca.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
 
+	var frames [][]byte
 	for {
-		// read opus frame length from dca file
-		err = binary.Read(file, binary.LittleEndian, &opuslen)
-
-		// If this is the end of the file, just return
-		if err == io.EOF || err == io.ErrUnexpectedEOF {
-			return nil
+		opus, err := nextGoodFrame(dr, path)
+		if err == io.EOF {
+			return frames, nil
 		}
-
 		if err != nil {
-			fmt.Println("error reading from dca file :", err)
-			return err
+			return nil, err
 		}
+		frames = append(frames, opus)
+	}
+}
 
-		// read encoded pcm from dca file
-		InBuf := make([]byte, opuslen)
-		err = binary.Read(file, binary.LittleEndian, &InBuf)
-
-		// Should not be any end of file errors
-		if err != nil {
-			fmt.Println("error reading from dca file :", err)
-			return err
-		}
+// Counts the frames in a dca file without loading them, up to the first bad one
+func dcaFrameCount(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
 
-		// append encoded pcm data to the buffer
-		s.buffer = append(s.buffer, InBuf)
+	frames, err := dca.CountFrames(file)
+	if _, ok := err.(*dca.FrameError); ok {
+		return frames, nil
 	}
+	return frames, err
 }
 
-// Unload this sound
-func (s *Sound) Unload() {
-	s.buffer = nil
+// A running pipeline read frame by frame
+type streamPipe struct {
+	p   *pipeline
+	out *dca.Reader
+
+	// Frames a prefetch already read out of the pipe, and the error it hit
+	// doing so if any
+	buffered [][]byte
+	err      error
 }
 
-func (s *Sound) isLoaded() bool {
-	if len(s.buffer) != 0 {
-		return true
+// Starts p and reads dca frames out of it
+func newStreamPipe(p *pipeline) (*streamPipe, error) {
+	if err := p.start(); err != nil {
+		return nil, err
 	}
-	return false
+	return &streamPipe{p: p, out: dca.NewRawReader(p)}, nil
 }
 
-// Load this sound
-func (s *Sound) Load(c *SoundCollection) error {
-	path := fmt.Sprintf("audio/%v_%v.dca", c.Prefix, s.Name)
-
-	file, err := os.Open(path)
+// Next opus frame out of the pipe. Once it runs dry, whatever made it fail
+// is returned instead of io.EOF.
+func (sp *streamPipe) next() ([]byte, error) {
+	if len(sp.buffered) > 0 {
+		opus := sp.buffered[0]
+		sp.buffered = sp.buffered[1:]
+		return opus, nil
+	}
+	if sp.err != nil {
+		return nil, sp.err
+	}
 
+	opus, err := sp.out.ReadFrame()
 	if err != nil {
-		fmt.Println("error opening dca file :", err)
-		return err
+		if perr := sp.p.wait(); perr != nil {
+			err = perr
+		}
 	}
+	return opus, err
+}
 
-	var opuslen int16
-
-	for {
-		// read opus frame length from dca file
-		err = binary.Read(file, binary.LittleEndian, &opuslen)
+// Kills whatever is still running in the pipe
+func (sp *streamPipe) kill() {
+	sp.p.close()
+}
 
-		// If this is the end of the file, just return
-		if err == io.EOF || err == io.ErrUnexpectedEOF {
-			return nil
-		}
+// Builds the ffmpeg arguments that turn input into raw PCM to encode, starting
+// offset into the audio with the guild's volume and normalization. The seek
+// goes before the input so ffmpeg jumps there instead of decoding everything
+// up to it.
+func ffmpegArgs(input string, offset time.Duration, settings GuildSettings) []string {
+	var args []string
+	if offset > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(offset.Seconds(), 'f', 2, 64))
+	}
+	args = append(args, "-i", input)
 
-		if err != nil {
-			fmt.Println("error reading from dca file :", err)
-			return err
-		}
+	var filters []string
+	if settings.Normalize {
+		// Single pass since we only get to see the stream once
+		filters = append(filters, "loudnorm="+loudnormTarget)
+	}
+	if settings.Volume != 100 {
+		filters = append(filters, "volume="+strconv.FormatFloat(float64(settings.Volume)/100, 'f', 2, 64))
+	}
+	if filters != nil {
+		args = append(args, "-af", strings.Join(filters, ","))
+	}
+	return append(args, "-f", "s16le", "-ar", "48000", "-ac", "2", "pipe:1")
+}
 
-		// read encoded pcm from dca file
-		InBuf := make([]byte, opuslen)
-		err = binary.Read(file, binary.LittleEndian, &InBuf)
+// Starts the ffmpeg/encoder pipeline for a file in audio/
+func startFilePipe(ctx context.Context, file string, offset time.Duration, settings GuildSettings) (*streamPipe, error) {
+	p := newPipeline(ctx)
+	p.add("ffmpeg", ffmpegArgs("audio/"+file, offset, settings)...)
+	p.encoded()
+	return newStreamPipe(p)
+}
 
-		// Should not be any end of file errors
+// Starts the youtube-dl/ffmpeg/encoder pipeline for a link. Starting at an
+// offset skips youtube-dl and has ffmpeg seek the media URL itself, a pipe
+// can't be seeked so ffmpeg would have to read all the way to the offset.
+func startStreamPipe(ctx context.Context, stream string, offset time.Duration, settings GuildSettings) (*streamPipe, error) {
+	if offset > 0 {
+		url, err := streamURL(ctx, stream)
 		if err != nil {
-			fmt.Println("error reading from dca file :", err)
-			return err
+			return nil, err
 		}
-
-		// append encoded pcm data to the buffer
-		s.buffer = append(s.buffer, InBuf)
+		return startURLPipe(ctx, url, offset, settings)
 	}
+
+	p := newPipeline(ctx)
+	p.add("youtube-dl", "-v", "-f", ytdlFormat(stream), "-o", "-", stream)
+	p.add("ffmpeg", ffmpegArgs("pipe:0", offset, settings)...)
+	p.encoded()
+	return newStreamPipe(p)
 }
 
-// PlayFile - Plays file
-func (s *Sound) PlayFile(vc *discordgo.VoiceConnection, file string) {
-	ffmpeg := exec.Command("ffmpeg", "-i", "audio/"+file, "-f", "s16le", "-ar", "48000", "-ac", "2", "pipe:1")
-	ffmpegout, err := ffmpeg.StdoutPipe()
-	if err != nil {
-		log.Println("ffmpeg StdoutPipe err:", err)
-		return
-	}
-	ffmpegbuf := bufio.NewReaderSize(ffmpegout, 16384)
+// Starts the ffmpeg/encoder pipeline straight off a media URL from streamURL
+func startURLPipe(ctx context.Context, url string, offset time.Duration, settings GuildSettings) (*streamPipe, error) {
+	p := newPipeline(ctx)
+	p.add("ffmpeg", ffmpegArgs(url, offset, settings)...)
+	p.encoded()
+	return newStreamPipe(p)
+}
 
-	dca := exec.Command("dca", "-raw", "-i", "pipe:0")
-	dca.Stdin = ffmpegbuf
-	dcaout, err := dca.StdoutPipe()
+// Asks youtube-dl for the media URL it would download stream from
+func streamURL(ctx context.Context, stream string) (string, error) {
+	out, err := commandOutput(ctx, "youtube-dl", "-g", "-f", ytdlFormat(stream), stream)
 	if err != nil {
-		log.Println("dca StdoutPipe err:", err)
-		return
+		return "", err
 	}
-	dcabuf := bufio.NewReaderSize(dcaout, 16384)
 
-	err = ffmpeg.Start()
-	if err != nil {
-		log.Println("ffmpeg Start err:", err)
-		return
+	url := strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0]
+	if url == "" {
+		return "", &PipelineError{Stage: "youtube-dl", Err: errors.New("no media URL")}
 	}
-	defer func() {
-		go ffmpeg.Wait()
-	}()
+	return url, nil
+}
 
-	err = dca.Start()
-	if err != nil {
-		log.Println("dca Start err:", err)
-		return
-	}
-	defer func() {
-		go dca.Wait()
-	}()
+// Plays a pipe started by start, restarting it whenever someone seeks or it
+// drops out before the end. Returns whatever stopped it early, if anything did.
+func (s *Sound) playPipe(vc *discordgo.VoiceConnection, start func(ctx context.Context, offset time.Duration) (*streamPipe, error)) error {
+	player := getPlayer(vc.GuildID)
 
-	// header "buffer"
-	var opuslen int16
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	// Send "speaking" packet over the voice websocket
 	vc.Speaking(true)
 	// Send not "speaking" packet over the websocket when we finish
 	defer vc.Speaking(false)
 
+	var (
+		offset  time.Duration
+		retries int
+	)
 	for {
-		// read dca opus length header
-		err = binary.Read(dcabuf, binary.LittleEndian, &opuslen)
-		if err == io.EOF || err == io.ErrUnexpectedEOF {
-			return
-		}
+		sp, err := start(ctx, offset)
 		if err != nil {
-			log.Println("read opus length from dca err:", err)
-			return
+			return err
 		}
 
-		// read opus data from dca
-		opus := make([]byte, opuslen)
-		err = binary.Read(dcabuf, binary.LittleEndian, &opus)
-		if err == io.EOF || err == io.ErrUnexpectedEOF {
-			return
-		}
-		if err != nil {
-			log.Println("read opus from dca err:", err)
-			return
+		frame, err := s.playFrames(vc, player, sp)
+		sp.kill()
+
+		// Connections reset now and then, pick it back up where it stopped as
+		// long as we got somewhere since the last try
+		if frame < 0 && err != nil && retries < STREAMRETRIES {
+			resume, ok := player.resumeFrame()
+			if ok && time.Duration(resume)*FRAMEDURATION > offset {
+				retries++
+				log.WithFields(log.Fields{
+					"sound": s.Name,
+					"frame": resume,
+					"error": err,
+					"retry": retries,
+				}).Warning("Stream dropped early, resuming")
+				frame = resume
+			}
 		}
 
-		if skipped[vc.GuildID] {
-			ffmpeg.Process.Kill()
-			dca.Process.Kill()
-			return
+		if frame < 0 {
+			if err == io.EOF {
+				err = nil
+			}
+			return err
 		}
-
-		// Send received PCM to the sendPCM channel
-		vc.OpusSend <- opus
+		offset = time.Duration(frame) * FRAMEDURATION
 	}
 }
 
-// PlayStream - Plays stream
-func (s *Sound) PlayStream(vc *discordgo.VoiceConnection, stream string) {
-	log.Info(stream)
-
-	if caching[vc.GuildID] {
-		go streamDownload(stream)
-	}
-
-	format := "bestaudio"
-	if strings.Contains(stream, "youtube.com") || strings.Contains(stream, "youtu.be") {
-		format = "mp4"
+// Sends frames from sp until it runs out or the play is skipped, returning -1
+// along with why it ran out, io.EOF if nothing went wrong. If someone seeks
+// the frame to seek to is returned instead.
+func (s *Sound) playFrames(vc *discordgo.VoiceConnection, player *GuildPlayer, sp *streamPipe) (int, error) {
+	next := sp.next
+	if JITTERDEPTH > 0 {
+		jb := newJitterBuffer(player, sp)
+		defer jb.close()
+		next = jb.next
 	}
 
-	ytdl := exec.Command("youtube-dl", "-v", "-f", format, "-o", "-", stream)
-	ytdlout, err := ytdl.StdoutPipe()
-	if err != nil {
-		log.Println("ytdl StdoutPipe err:", err)
-		return
-	}
-	ytdlbuf := bufio.NewReaderSize(ytdlout, 16384)
-
-	ffmpeg := exec.Command("ffmpeg", "-i", "pipe:0", "-f", "s16le", "-ar", "48000", "-ac", "2", "pipe:1")
-	ffmpeg.Stdin = ytdlbuf
-	ffmpegout, err := ffmpeg.StdoutPipe()
-	if err != nil {
-		log.Println("ffmpeg StdoutPipe err:", err)
-		return
-	}
-	ffmpegbuf := bufio.NewReaderSize(ffmpegout, 16384)
-
-	dca := exec.Command("dca", "-raw", "-i", "pipe:0")
-	dca.Stdin = ffmpegbuf
-	dcaout, err := dca.StdoutPipe()
-	if err != nil {
-		log.Println("dca StdoutPipe err:", err)
-		return
-	}
-	dcabuf := bufio.NewReaderSize(dcaout, 16384)
-
-	err = ytdl.Start()
-	if err != nil {
-		log.Println("ytdl Start err:", err)
-		return
-	}
-	defer func() {
-		go ytdl.Wait()
-	}()
+	for {
+		if frame, ok := player.takeSeek(); ok {
+			return frame, nil
+		}
 
-	err = ffmpeg.Start()
-	if err != nil {
-		log.Println("ffmpeg Start err:", err)
-		return
-	}
-	defer func() {
-		go ffmpeg.Wait()
-	}()
+		opus, err := next()
+		// A last frame cut short by the pipe closing is just the end of it
+		if ferr, ok := err.(*dca.FrameError); ok && ferr.Err == io.ErrUnexpectedEOF {
+			return -1, io.EOF
+		}
+		if err != nil {
+			return -1, err
+		}
 
-	err = dca.Start()
-	if err != nil {
-		log.Println("dca Start err:", err)
-		return
+		// Send received PCM to the sendPCM channel
+		if !player.send(vc, opus) {
+			return -1, nil
+		}
 	}
-	defer func() {
-		go dca.Wait()
-	}()
+}
 
-	// header "buffer"
-	var opuslen int16
+// PlayFile - Plays file
+func (s *Sound) PlayFile(vc *discordgo.VoiceConnection, file string) error {
+	return s.playPipe(vc, func(ctx context.Context, offset time.Duration) (*streamPipe, error) {
+		return startFilePipe(ctx, file, offset, getPlayer(vc.GuildID).Settings())
+	})
+}
 
-	// Send "speaking" packet over the voice websocket
-	vc.Speaking(true)
-	// Send not "speaking" packet over the websocket when we finish
-	defer vc.Speaking(false)
+// PlayStream - Plays stream
+func (s *Sound) PlayStream(vc *discordgo.VoiceConnection, stream string) error {
+	log.Info(stream)
 
-	for {
-		// read dca opus length header
-		err = binary.Read(dcabuf, binary.LittleEndian, &opuslen)
-		if err == io.EOF || err == io.ErrUnexpectedEOF {
-			return
-		}
-		if err != nil {
-			log.Println("read opus length from dca err:", err)
-			return
+	player := getPlayer(vc.GuildID)
+	if settings := player.Settings(); settings.Caching {
+		var title string
+		if current := player.Current(); current != nil && current.Sound == s {
+			title = current.Title
 		}
+		go streamDownload(stream, settings.Normalize, newDCAMetadata(title, "youtube-dl", stream, ""))
+	}
 
-		// read opus data from dca
-		opus := make([]byte, opuslen)
-		err = binary.Read(dcabuf, binary.LittleEndian, &opus)
-		if err == io.EOF || err == io.ErrUnexpectedEOF {
-			return
-		}
-		if err != nil {
-			log.Println("read opus from dca err:", err)
-			return
+	// Looked up the first time the stream restarts and reused after, so
+	// resuming a dropped stream doesn't wait on youtube-dl again
+	var url string
+	return s.playPipe(vc, func(ctx context.Context, offset time.Duration) (*streamPipe, error) {
+		if offset == 0 {
+			// If this was prefetched while the last play was going, pick it up
+			if sp := player.takePrefetch(s); sp != nil {
+				return sp, nil
+			}
+			return startStreamPipe(ctx, stream, 0, player.Settings())
 		}
 
-		if skipped[vc.GuildID] {
-			ytdl.Process.Kill()
-			ffmpeg.Process.Kill()
-			dca.Process.Kill()
-			return
+		if url == "" {
+			var err error
+			if url, err = streamURL(ctx, stream); err != nil {
+				return nil, err
+			}
 		}
+		return startURLPipe(ctx, url, offset, player.Settings())
+	})
+}
 
-		// Send received PCM to the sendPCM channel
-		vc.OpusSend <- opus
+// youtube-dl format to ask for when downloading stream
+func ytdlFormat(stream string) string {
+	if strings.Contains(stream, "youtube.com") || strings.Contains(stream, "youtu.be") {
+		return "mp4"
 	}
+	return "bestaudio"
 }
 
-func streamDownload(stream string, name ...string) string {
+// Caches stream into audio/, as name if given, described by meta
+func streamDownload(stream string, normalize bool, meta *dca.Metadata, name ...string) string {
 	id, err := getIDFromLink(stream)
 	log.Info(stream)
 	if err != nil {
@@ -640,86 +743,65 @@ func streamDownload(stream string, name ...string) string {
 		dcaName = getDCAfromLink(stream)
 	}
 
-	format := "bestaudio"
-	if strings.Contains(stream, "youtube.com") || strings.Contains(stream, "youtu.be") {
-		format = "mp4"
+	if normalize {
+		return normalizedDownload(stream, dcaName, meta)
 	}
 
-	ytdl := exec.Command("youtube-dl", "-v", "-f", format, "-o", "-", stream)
-	ytdlout, err := ytdl.StdoutPipe()
-	if err != nil {
-		log.Println("ytdl StdoutPipe err:", err)
-		return "youtube-dl StdoutPipe error"
-	}
-	ytdlbuf := bufio.NewReaderSize(ytdlout, 16384)
-
-	ffmpeg := exec.Command("ffmpeg", "-i", "pipe:0", "-f", "s16le", "-ar", "48000", "-ac", "2", "pipe:1")
-	ffmpeg.Stdin = ytdlbuf
-	ffmpegout, err := ffmpeg.StdoutPipe()
-	if err != nil {
-		log.Println("ffmpeg StdoutPipe err:", err)
-		return "ffmpeg StdoutPipe error"
+	p := newPipeline(context.Background())
+	p.add("youtube-dl", "-v", "-f", ytdlFormat(stream), "-o", "-", stream)
+	p.add("ffmpeg", "-i", "pipe:0", "-f", "s16le", "-ar", "48000", "-ac", "2", "pipe:1")
+	p.encoded()
+	if err = p.saveTo("audio/"+dcaName, meta); err != nil {
+		log.Println("download err:", err)
+		return stageError(err)
 	}
-	ffmpegbuf := bufio.NewReaderSize(ffmpegout, 16384)
-
-	dca := exec.Command("dca", "-raw", "-i", "pipe:0")
-	dca.Stdin = ffmpegbuf
-	outfile, err := os.Create("audio/" + dcaName)
-	if err != nil {
-		log.Println("file creation err:", err)
-		return "file creation error"
-	}
-	defer outfile.Close()
-	dca.Stdout = outfile
-
-	err = ytdl.Start()
-	if err != nil {
-		log.Println("ytdl Start err:", err)
-		return "youtube-dl error"
-	}
-	defer func() {
-		go ytdl.Wait()
-	}()
-
-	err = ffmpeg.Start()
-	if err != nil {
-		log.Println("ffmpeg Start err:", err)
-		return "ffmpeg error"
-	}
-	defer func() {
-		go ffmpeg.Wait()
-	}()
-
-	err = dca.Start()
-	if err != nil {
-		log.Println("dca Start err:", err)
-		return "dca error"
-	}
-	defer dca.Wait()
 
 	return SUCCESS
 }
 
-// Play this sound over the specified VoiceConnection
-func (s *Sound) Play(vc *discordgo.VoiceConnection) {
+// Play this sound over the specified VoiceConnection, returning why it
+// couldn't be played to the end if it was cut short
+func (s *Sound) Play(vc *discordgo.VoiceConnection) error {
 	nameType := strings.Split(s.Name, "@")
 	if len(nameType) > 1 {
 		if nameType[1] == "stream" {
-			s.PlayStream(vc, nameType[0])
-			return
+			return s.PlayStream(vc, nameType[0])
 		} else if nameType[1] == "file" {
-			s.PlayFile(vc, nameType[0])
-			return
+			return s.PlayFile(vc, nameType[0])
 		}
 	}
 	vc.Speaking(true)
 	defer vc.Speaking(false)
 
-	for _, buff := range s.buffer {
-		if skipped[vc.GuildID] {
-			return
+	player := getPlayer(vc.GuildID)
+
+	sf, err := openSound(s.file())
+	if err != nil {
+		return err
+	}
+	defer sf.close()
+
+	// Stored frames are already encoded, so anything not at 100% volume
+	// gets decoded and encoded again
+	var volume volumeAdjuster
+
+	for {
+		if frame, ok := player.takeSeek(); ok {
+			if err = sf.seek(frame); err != nil {
+				return err
+			}
+		}
+
+		opus, err := sf.next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if !player.send(vc, volume.apply(opus, player.Settings().Volume)) {
+			return nil
 		}
-		vc.OpusSend <- buff
 	}
 }
 
@@ -727,7 +809,76 @@ func (s *Sound) Play(vc *discordgo.VoiceConnection) {
 // IF WE WANT TO PROCESS VOTES MAKE A NEW FUNCTION
 // CALL IT votes OR SOMETHING
 func skip(g *discordgo.Guild) {
-	skipped[g.ID] = true
+	getPlayer(g.ID).Skip()
+}
+
+// Skip for people allowed to do it on their own, everyone else gets a vote
+// among the people listening in the bot's channel
+func votes(s *discordgo.Session, m *discordgo.MessageCreate, g *discordgo.Guild) string {
+	player := getPlayer(g.ID)
+	current, _, _ := player.Queue()
+	channelID := player.VoiceChannel()
+	if current == nil || channelID == "" {
+		return "Nothing is playing"
+	}
+
+	if current.UserID == m.Author.ID || isDJ(g, m.Author.ID, m.ChannelID) || player.Settings().SkipRatio <= 0 {
+		skip(g)
+		log.Info(m.Author.ID + " skipped")
+		return "<@" + m.Author.ID + "> skipped"
+	}
+
+	var listeners []string
+	listening := false
+	for _, vs := range g.VoiceStates {
+		if vs.ChannelID != channelID || vs.UserID == s.State.User.ID {
+			continue
+		}
+		listeners = append(listeners, vs.UserID)
+		if vs.UserID == m.Author.ID {
+			listening = true
+		}
+	}
+	if !listening {
+		return "You have to be listening to vote"
+	}
+
+	count, needed, skipped := player.Vote(m.Author.ID, listeners)
+	if skipped {
+		log.Info(m.Author.ID + " vote skipped")
+		return "Vote passed, skipped"
+	}
+	return fmt.Sprintf("<@%s> voted to skip, %d/%d", m.Author.ID, count, needed)
+}
+
+// True if userID queued the play the guild is playing right now
+func queuedCurrent(guildID, userID string) bool {
+	current := getPlayer(guildID).Current()
+	return current != nil && current.UserID == userID
+}
+
+// True if userID can skip and change player settings without a vote, either
+// through a role called DJ or by being able to manage the server
+func isDJ(g *discordgo.Guild, userID, channelID string) bool {
+	if userID == OWNER || userID == g.OwnerID {
+		return true
+	}
+
+	perms, err := discord.State.UserChannelPermissions(userID, channelID)
+	if err == nil && perms&(discordgo.PermissionAdministrator|discordgo.PermissionManageServer) != 0 {
+		return true
+	}
+
+	member, err := discord.State.Member(g.ID, userID)
+	if err != nil || member == nil {
+		return false
+	}
+	for _, role := range g.Roles {
+		if strings.EqualFold(role.Name, "dj") && scontains(role.ID, member.Roles...) {
+			return true
+		}
+	}
+	return false
 }
 
 // Attempts to find the current users voice channel inside a given guild
@@ -764,6 +915,7 @@ func createPlay(user *discordgo.User, guild *discordgo.Guild, coll *SoundCollect
 		GuildID:   guild.ID,
 		ChannelID: channel.ID,
 		UserID:    user.ID,
+		UserName:  user.Username,
 		Sound:     sound,
 		Forced:    true,
 	}
@@ -773,6 +925,10 @@ func createPlay(user *discordgo.User, guild *discordgo.Guild, coll *SoundCollect
 		play.Sound = coll.Random()
 		play.Forced = false
 	}
+	if coll.Prefix != "" {
+		play.Title = coll.Prefix + "_" + play.Sound.Name
+		play.Duration = play.Sound.duration()
+	}
 
 	// If the collection is a chained one, set the next sound
 	if coll.ChainWith != nil {
@@ -780,6 +936,7 @@ func createPlay(user *discordgo.User, guild *discordgo.Guild, coll *SoundCollect
 			GuildID:   play.GuildID,
 			ChannelID: play.ChannelID,
 			UserID:    play.UserID,
+			UserName:  play.UserName,
 			Sound:     coll.ChainWith.Random(),
 			Forced:    play.Forced,
 		}
@@ -788,11 +945,126 @@ func createPlay(user *discordgo.User, guild *discordgo.Guild, coll *SoundCollect
 	return play
 }
 
-func listQueue(s *discordgo.Session, m *discordgo.MessageCreate, g *discordgo.Guild) {
-	_, exists := queues[g.ID]
-	if exists {
-		s.ChannelMessageSend(m.ChannelID, strconv.Itoa(len(queues[g.ID])))
+// Number of queue entries lq shows per page
+const queuePageSize = 10
+
+func listQueue(s *discordgo.Session, m *discordgo.MessageCreate, g *discordgo.Guild, page int) {
+	current, elapsed, queue := getPlayer(g.ID).Queue()
+	if current == nil {
+		s.ChannelMessageSend(m.ChannelID, "Nothing is playing")
+		return
+	}
+
+	// Time left, counting whatever is left of the current play
+	var remaining time.Duration
+	unknown := 0
+	if current.Duration > 0 {
+		if left := current.Duration - elapsed; left > 0 {
+			remaining += left
+		}
+	} else {
+		unknown++
+	}
+	for _, play := range queue {
+		if play.Duration > 0 {
+			remaining += play.Duration
+		} else {
+			unknown++
+		}
+	}
+
+	pages := (len(queue) + queuePageSize - 1) / queuePageSize
+	if pages == 0 {
+		pages = 1
+	}
+	if page < 1 {
+		page = 1
+	} else if page > pages {
+		page = pages
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Now playing: `%s` [%s / %s] requested by %s", current.title(), durationFormat(elapsed), durationFormat(current.Duration), current.UserName)
+	if repeat := getPlayer(g.ID).Settings().Repeat; repeat != RepeatOff {
+		fmt.Fprintf(buf, " (loop: %s)", repeat)
+	}
+	fmt.Fprintf(buf, "\n")
+	if len(queue) == 0 {
+		fmt.Fprintf(buf, "Nothing queued\n")
+	} else {
+		fmt.Fprintf(buf, "Up next (page %d/%d):\n", page, pages)
+		first := (page - 1) * queuePageSize
+		for i := first; i < len(queue) && i < first+queuePageSize; i++ {
+			fmt.Fprintf(buf, "`%d.` `%s` [%s] requested by %s\n", i+1, queue[i].title(), durationFormat(queue[i].Duration), queue[i].UserName)
+		}
+	}
+	fmt.Fprintf(buf, "Remaining: %s over %d tracks", durationFormat(remaining), len(queue)+1)
+	if unknown > 0 {
+		fmt.Fprintf(buf, " (%d of unknown length)", unknown)
+	}
+	s.ChannelMessageSend(m.ChannelID, buf.String())
+}
+
+// Width of the np progress bar in characters
+const progressBarWidth = 20
+
+// Draws a text progress bar like [=====>-----]
+func progressBar(elapsed, total time.Duration) string {
+	filled := 0
+	if total > 0 {
+		filled = int(int64(progressBarWidth) * int64(elapsed) / int64(total))
+	}
+	if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat("-", progressBarWidth-filled-1)
 	}
+	return "[" + bar + "]"
+}
+
+func nowPlaying(s *discordgo.Session, m *discordgo.MessageCreate, g *discordgo.Guild) {
+	player := getPlayer(g.ID)
+	current, elapsed, queue := player.Queue()
+	if current == nil {
+		s.ChannelMessageSend(m.ChannelID, "Nothing is playing")
+		return
+	}
+
+	// Playlist entries don't get looked up when they're queued, so do it now
+	title, total := current.title(), current.Duration
+	if total == 0 && current.Link != "" {
+		if t, d, err := trackInfo(current.Link, false); err == nil {
+			title, total = t, d
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Now playing: `%s`\n", title)
+	fmt.Fprintf(buf, "Requested by %s\n", current.UserName)
+	if current.Link != "" {
+		fmt.Fprintf(buf, "<%s>\n", current.Link)
+	}
+
+	fmt.Fprintf(buf, "`%s` %s / %s", progressBar(elapsed, total), durationFormat(elapsed), durationFormat(total))
+	if player.Paused() {
+		fmt.Fprintf(buf, " (paused)")
+	}
+	if repeat := player.Settings().Repeat; repeat != RepeatOff {
+		fmt.Fprintf(buf, " (loop: %s)", repeat)
+	}
+	fmt.Fprintf(buf, "\n")
+
+	if len(queue) > 0 {
+		if total > elapsed {
+			fmt.Fprintf(buf, "Next up in %s: `%s`", durationFormat(total-elapsed), queue[0].title())
+		} else {
+			fmt.Fprintf(buf, "Next up: `%s`", queue[0].title())
+		}
+	}
+	s.ChannelMessageSend(m.ChannelID, buf.String())
 }
 
 // Prepares and enqueues a play into the ratelimit/buffer guild queue
@@ -802,21 +1074,31 @@ func enqueuePlay(user *discordgo.User, guild *discordgo.Guild, coll *SoundCollec
 		return
 	}
 
-	// Check if we already have a connection to this guild
-	//   yes, this isn't threadsafe, but its "OK" 99% of the time
-	_, exists := queues[guild.ID]
+	// Soundboard clips jump ahead of whatever music is playing
+	if getPlayer(guild.ID).interrupt(play) {
+		return
+	}
+	queuePlay(play, s...)
+}
 
-	if exists {
-		if len(queues[guild.ID]) < MAXQSIZE {
-			queues[guild.ID] <- play
-		}
-	} else {
-		queues[guild.ID] = make(chan *Play, MAXQSIZE)
-		if s != nil {
-			playSound(play, nil, s[0])
-		} else {
-			playSound(play, nil)
-		}
+// Prepares and enqueues a music track requested by m, along with what we know
+// about it for lq
+func enqueueTrack(m *discordgo.MessageCreate, guild *discordgo.Guild, sound *Sound, title, link string, duration time.Duration, s *discordgo.Session) {
+	play := createPlay(m.Author, guild, createEmptySC(), sound)
+	if play == nil {
+		return
+	}
+	play.TextChannelID = m.ChannelID
+	play.Title = title
+	play.Link = link
+	play.Duration = duration
+	queuePlay(play, s)
+}
+
+func queuePlay(play *Play, s ...*discordgo.Session) {
+	// If the guild is already playing, the play just waits in its queue
+	if getPlayer(play.GuildID).enqueue(play) {
+		playSound(play, nil, s...)
 	}
 }
 
@@ -854,7 +1136,14 @@ func trackSoundStats(play *Play) {
 	}
 }
 
+// Link a cached file came from, out of its metadata or failing that its name
 func ytDCAtoLink(ytDCA string) string {
+	if isDCA(ytDCA) {
+		if meta, err := readDCAMetadata(ytDCA); err == nil && meta != nil && meta.Origin.URL != "" {
+			return meta.Origin.URL
+		}
+	}
+
 	split := strings.SplitN(ytDCA, "_", 2)
 	if split[0] != "yt" {
 		return ""
@@ -863,87 +1152,197 @@ func ytDCAtoLink(ytDCA string) string {
 	return "youtu.be/" + idsplit[0]
 }
 
-// Play a sound
+// Play a sound, then keep playing whatever gets queued behind it until the
+// guild's queue runs dry
 func playSound(play *Play, vc *discordgo.VoiceConnection, s ...*discordgo.Session) (err error) {
-	log.WithFields(log.Fields{
-		"play": play,
-	}).Info("Playing sound")
-
-	skipped[play.GuildID] = false
-
-	loaded := play.Sound.isLoaded()
+	player := getPlayer(play.GuildID)
 
-	if vc == nil {
-		vc, err = discord.ChannelVoiceJoin(play.GuildID, play.ChannelID, false, false)
-		// vc.Receive = false
+	for play != nil {
+		vc, err = playChain(player, play, vc, s...)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"error": err,
-			}).Error("Failed to play sound")
-			delete(queues, play.GuildID)
+			discardAttachments([]*Play{play})
+			player.reset()
 			return err
 		}
-	}
 
-	// If we need to change channels, do that now
-	if vc.ChannelID != play.ChannelID {
-		vc.ChangeChannel(play.ChannelID, false, false)
-		time.Sleep(time.Millisecond * 125)
+		// If there is another song in the queue, play that
+		next := player.next(play)
+		if next == nil && player.wantsAutoplay() {
+			next = autoplayNext(play)
+		}
+		if next != nil {
+			play = next
+			continue
+		}
+
+		// If the queue is empty, give it a moment and then leave
+		time.Sleep(time.Millisecond * time.Duration(play.Sound.PartDelay))
+		play = player.finish(vc)
+		if play == nil {
+			vc = nil
+		}
 	}
 
-	// Track stats for this play in redis
-	go trackSoundStats(play)
+	if len(s) > 0 {
+		s[0].UpdateStatus(0, "Nothing")
+	}
+	return nil
+}
 
-	// Sleep for a specified amount of time before playing the sound
-	time.Sleep(time.Millisecond * 32)
+// Picks a cached track out of audio/ for autoplay, weighted by how often each
+// one has been played. Avoids repeating last if there's anything else.
+func autoplayPick(last string) string {
+	files, err := ioutil.ReadDir("audio")
+	if err != nil {
+		log.Info("autoplay readdir err: ", err)
+		return ""
+	}
 
-	// Play the sound
-	if len(s) > 0 {
-		link := ytDCAtoLink(play.Sound.Name)
-		if link != "" {
-			s[0].UpdateStatus(0, link)
-		} else {
-			s[0].UpdateStatus(0, play.Sound.Name)
+	var names []string
+	for _, f := range files {
+		name := f.Name()
+		if !isDCA(name) || name == last {
+			continue
+		}
+		if strings.HasPrefix(name, "yt_") || strings.HasPrefix(name, "sc_") || strings.HasPrefix(name, "tag_") {
+			names = append(names, name)
 		}
 	}
-
-	if !loaded {
-		play.Sound.LoadNow()
+	if len(names) == 0 {
+		if fileExists(last) {
+			return last
+		}
+		return ""
 	}
-	play.Sound.Play(vc)
-	//Will wait till next song is done to do this shit
-	log.Info("Played song, advance queue")
-	//Put shit here to advance the "fake" queue text
-	//vc.GuildID
-	advanceQueueList(vc.GuildID)
-	if !loaded {
-		play.Sound.Unload()
+
+	// Every track gets a weight of one plus however many times it's been played
+	var results []*redis.StringCmd
+	if rcli != nil {
+		rcli.Pipelined(func(pipe *redis.Pipeline) error {
+			for _, name := range names {
+				results = append(results, pipe.Get("airhorn:f:sound:"+name))
+			}
+			return nil
+		})
 	}
 
-	// If this is chained, play the chained sound
-	if play.Next != nil {
-		playSound(play.Next, vc)
+	weights := make([]int, len(names))
+	total := 0
+	for i := range names {
+		weights[i] = 1
+		if i < len(results) {
+			plays, _ := strconv.Atoi(results[i].Val())
+			weights[i] += plays
+		}
+		total += weights[i]
 	}
 
-	// If there is another song in the queue, recurse and play that
-	if len(queues[play.GuildID]) > 0 {
-		nextPlay := <-queues[play.GuildID]
-		if s != nil {
-			playSound(nextPlay, vc, s[0])
-		} else {
-			playSound(nextPlay, vc)
+	number := randomRange(0, total)
+	for i, weight := range weights {
+		number -= weight
+		if number < 0 {
+			return names[i]
 		}
+	}
+	return names[len(names)-1]
+}
+
+// Builds the play autoplay follows last with, nil if there's nothing cached
+func autoplayNext(last *Play) *Play {
+	name := autoplayPick(last.Sound.Name)
+	if name == "" {
 		return nil
 	}
 
-	// If the queue is empty, delete it
-	time.Sleep(time.Millisecond * time.Duration(play.Sound.PartDelay))
-	delete(queues, play.GuildID)
-	vc.Disconnect()
-	if len(s) > 0 {
-		s[0].UpdateStatus(0, "Nothing")
+	play := &Play{
+		GuildID:       last.GuildID,
+		ChannelID:     last.ChannelID,
+		TextChannelID: last.TextChannelID,
+		UserID:        discord.State.User.ID,
+		UserName:      "autoplay",
+		Sound:         createSound(name, 1, 250),
+		Title:         name,
+		Link:          ytDCAtoLink(name),
+		Queued:        time.Now(),
+	}
+	if meta, err := readDCAMetadata(name); err == nil && meta != nil && meta.Info.Title != "" {
+		play.Title = meta.Info.Title
+	}
+	if frames, err := dcaFrameCount("audio/" + name); err == nil {
+		play.Duration = time.Duration(frames) * FRAMEDURATION
 	}
-	return nil
+	return play
+}
+
+// Plays a single play along with any chained plays, joining or moving the
+// voice connection as needed. Returns the connection it ended up using.
+func playChain(player *GuildPlayer, play *Play, vc *discordgo.VoiceConnection, s ...*discordgo.Session) (*discordgo.VoiceConnection, error) {
+	var err error
+
+	for ; play != nil; play = play.Next {
+		log.WithFields(log.Fields{
+			"play": play,
+		}).Info("Playing sound")
+		play.failed = false
+
+		// Don't keep hammering links that never work
+		if reason := knownFailure(streamLink(play)); reason != "" {
+			play.failed = true
+			reportFailure(play, reason, s...)
+			continue
+		}
+
+		if vc == nil {
+			vc, err = discord.ChannelVoiceJoin(play.GuildID, play.ChannelID, false, false)
+			// vc.Receive = false
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Error("Failed to play sound")
+				return nil, err
+			}
+
+			announceRecording(player, play)
+		}
+
+		// If we need to change channels, do that now
+		if vc.ChannelID != play.ChannelID {
+			vc.ChangeChannel(play.ChannelID, false, false)
+			time.Sleep(time.Millisecond * 125)
+			announceRecording(player, play)
+		}
+		player.nowPlaying(play, vc)
+
+		// Track stats for this play in redis
+		go trackSoundStats(play)
+
+		// Sleep for a specified amount of time before playing the sound
+		time.Sleep(time.Millisecond * 32)
+
+		// Play the sound
+		if len(s) > 0 {
+			link := ytDCAtoLink(play.Sound.Name)
+			if link != "" {
+				s[0].UpdateStatus(0, link)
+			} else {
+				s[0].UpdateStatus(0, play.Sound.Name)
+			}
+		}
+
+		if perr := play.Sound.Play(vc); perr != nil {
+			play.failed = true
+			playFailed(play, perr, s...)
+		} else if link := streamLink(play); link != "" {
+			clearFailure(link)
+		}
+		//Will wait till next song is done to do this shit
+		log.Info("Played song, advance queue")
+		//Put shit here to advance the "fake" queue text
+		//vc.GuildID
+		advanceQueueList(vc.GuildID)
+	}
+
+	return vc, nil
 }
 
 func onReady(s *discordgo.Session, event *discordgo.Ready) {
@@ -952,7 +1351,7 @@ func onReady(s *discordgo.Session, event *discordgo.Ready) {
 }
 
 func onGuildCreate(s *discordgo.Session, event *discordgo.GuildCreate) {
-	if event.Guild.Unavailable || queues[event.Guild.ID] == nil {
+	if event.Guild.Unavailable || !getPlayer(event.Guild.ID).Playing() {
 		return
 	}
 
@@ -1002,6 +1401,9 @@ func displayBotStats(cid string) {
 	fmt.Fprintf(w, "Tasks: \t%d\n", runtime.NumGoroutine())
 	fmt.Fprintf(w, "Servers: \t%d\n", len(discord.State.Ready.Guilds))
 	fmt.Fprintf(w, "Users: \t%d\n", users)
+	fmt.Fprintf(w, "Jitter: \t%d underruns, %d overruns\n", atomic.LoadInt64(&jitterUnderruns), atomic.LoadInt64(&jitterOverruns))
+	cached, cachedSounds := sounds.usage()
+	fmt.Fprintf(w, "Sound cache: \t%s / %s in %d sounds, %d hits, %d misses\n", humanize.Bytes(uint64(cached)), humanize.Bytes(uint64(CACHEBYTES)), cachedSounds, atomic.LoadInt64(&soundCacheHits), atomic.LoadInt64(&soundCacheMisses))
 	fmt.Fprintf(w, "```\n")
 	w.Flush()
 	discord.ChannelMessageSend(cid, buf.String())
@@ -1151,17 +1553,85 @@ func getInfoFromLink(link string) (title, id, duration, latency string, err erro
 
 	start := time.Now()
 	//info := []string{"Name", "Id", "Duration", "Lat"}
-	cmd := exec.Command("youtube-dl", "--get-title", "--get-id", "--get-duration", link)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err = cmd.Run()
+	out, err := commandOutput(context.Background(), "youtube-dl", "--get-title", "--get-id", "--get-duration", link)
 	if err != nil {
 		return "", "", "", "", err
 	}
-	info := strings.Split(out.String(), "\n")
+	info := strings.Split(string(out), "\n")
 	return info[0], info[1], info[2], time.Since(start).String(), nil
 }
 
+// Looks up the title and duration of a link for the queue. Silent lookups come
+// from playlists, so they only use the YouTube API since running youtube-dl for
+// every entry would take forever.
+func trackInfo(link string, silent bool) (title string, duration time.Duration, err error) {
+	fast := YTAPIKEY != "" && (strings.Contains(link, "youtube.com") || strings.Contains(link, "youtu.be"))
+	if silent && !fast {
+		return "", 0, nil
+	}
+
+	title, _, length, _, err := getInfoFromLink(link)
+	if err != nil {
+		return "", 0, err
+	}
+	duration, _ = parseDuration(length)
+	return title, duration, nil
+}
+
+// Parses durations in either the YouTube API (PT1H2M3S) or youtube-dl (1:02:03)
+// format, returning false if it can't. 0:00 is a perfectly good duration, so
+// the zero value doesn't say anything about whether it parsed.
+func parseDuration(length string) (time.Duration, bool) {
+	var duration time.Duration
+
+	if strings.HasPrefix(length, "P") {
+		var number int
+		for _, c := range length[1:] {
+			switch {
+			case c >= '0' && c <= '9':
+				number = number*10 + int(c-'0')
+				continue
+			case c == 'T':
+			case c == 'W':
+				duration += time.Duration(number) * 7 * 24 * time.Hour
+			case c == 'D':
+				duration += time.Duration(number) * 24 * time.Hour
+			case c == 'H':
+				duration += time.Duration(number) * time.Hour
+			case c == 'M':
+				duration += time.Duration(number) * time.Minute
+			case c == 'S':
+				duration += time.Duration(number) * time.Second
+			default:
+				return 0, false
+			}
+			number = 0
+		}
+		return duration, len(length) > 1
+	}
+
+	for _, part := range strings.Split(strings.TrimSpace(length), ":") {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 {
+			return 0, false
+		}
+		duration = duration*60 + time.Duration(number)*time.Second
+	}
+	return duration, true
+}
+
+// Formats a duration as 1:02:03 or 2:03, "?" if it's unknown
+func durationFormat(d time.Duration) string {
+	if d <= 0 {
+		return "?"
+	}
+	secs := int(d.Seconds())
+	if secs >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", secs/3600, (secs/60)%60, secs%60)
+	}
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
+
 func returnStringOrError(s string, err error) string {
 	if err != nil {
 		return err.Error()
@@ -1169,21 +1639,49 @@ func returnStringOrError(s string, err error) string {
 	return s
 }
 
-func playDCA(s *discordgo.Session, m *discordgo.MessageCreate, g *discordgo.Guild, dca string, silent bool) {
-	qm := "Queued: " + dca
-	link := ytDCAtoLink(dca)
-	dcaSplit := strings.SplitN(dca, "_", 2)
+func playDCA(s *discordgo.Session, m *discordgo.MessageCreate, g *discordgo.Guild, file string, silent bool) {
+	// Files with metadata say what they are, older ones get worked out from
+	// their name
+	if meta, err := readDCAMetadata(file); err == nil && meta != nil {
+		title := meta.Info.Title
+		if title == "" {
+			title = file
+		}
+		if !silent {
+			s.ChannelMessageSend(m.ChannelID, "Queued: "+title)
+		}
+		go enqueueTrack(m, g, createSound(file, 1, 250), title, meta.Origin.URL, meta.Duration(), s)
+		return
+	}
+
+	qm := "Queued: " + file
+	title := file
+	link := ytDCAtoLink(file)
+	dcaSplit := strings.SplitN(file, "_", 2)
 	if link != "" {
-		qm = "Queued: " + returnStringOrError(getInfoPartFromLink(link, 0))
+		var err error
+		title, _, err = trackInfo(link, silent)
+		qm = "Queued: " + returnStringOrError(title, err)
+		if err != nil {
+			title = ""
+		}
 	} else if dcaSplit[0] == "tag" {
 		dcaSplit = strings.Split(dcaSplit[1], ".")
 		qm = "Queued tag: " + dcaSplit[0]
+		title = "tag " + dcaSplit[0]
 	}
 	if !silent {
 		s.ChannelMessageSend(m.ChannelID, qm)
 	}
 
-	go enqueuePlay(m.Author, g, createEmptySC(), createSound(dca, 1, 250), s)
+	// Cached files know their own length
+	var duration time.Duration
+	frames, err := dcaFrameCount("audio/" + file)
+	if err == nil {
+		duration = time.Duration(frames) * FRAMEDURATION
+	}
+
+	go enqueueTrack(m, g, createSound(file, 1, 250), title, link, duration, s)
 }
 
 func isDCA(possDCA string) bool {
@@ -1200,14 +1698,24 @@ func play(s *discordgo.Session, m *discordgo.MessageCreate, g *discordgo.Guild,
 		playDCA(s, m, g, toPlay, silent)
 		return
 	}
+	if reason := knownFailure(toPlay); reason != "" {
+		if !silent {
+			go s.ChannelMessageSend(m.ChannelID, "Not queuing "+toPlay+": "+reason)
+		}
+		return
+	}
+	title, duration, err := trackInfo(toPlay, silent)
 	if !silent {
-		go s.ChannelMessageSend(m.ChannelID, "Queued: "+returnStringOrError(getInfoPartFromLink(toPlay, 0)))
+		go s.ChannelMessageSend(m.ChannelID, "Queued: "+returnStringOrError(title, err))
 	}
-	go enqueuePlay(m.Author, g, createEmptySC(), createSound(toPlay+"@stream", 1, 250), s)
+	if err != nil {
+		title = ""
+	}
+	go enqueueTrack(m, g, createSound(toPlay+"@stream", 1, 250), title, toPlay, duration, s)
 }
 
 func playFile(s *discordgo.Session, m *discordgo.MessageCreate, g *discordgo.Guild, file string) {
-	go enqueuePlay(m.Author, g, createEmptySC(), createSound(file, 1, 250), s)
+	go enqueueTrack(m, g, createSound(file, 1, 250), file, "", 0, s)
 }
 
 func getDCAfromLink(link string) string {
@@ -1305,6 +1813,8 @@ func delDCA(DCA string) string {
 		log.Info(rmerr)
 		return "The file is a persistant bastard."
 	}
+	// Measured loudness, if it was normalized
+	os.Remove(loudnessPath(DCA))
 	return "File removed"
 }
 
@@ -1336,7 +1846,9 @@ func tagLink(s *discordgo.Session, m *discordgo.MessageCreate, g *discordgo.Guil
 	}
 
 	s.ChannelMessageSend(m.ChannelID, "Downloading tag: "+tag)
-	result := streamDownload(link, tagDCA)
+	title, _, _ := trackInfo(link, true)
+	meta := newDCAMetadata(title, "youtube-dl", link, m.Author.Username)
+	result := streamDownload(link, getPlayer(g.ID).Settings().Normalize, meta, tagDCA)
 	if result != SUCCESS {
 		s.ChannelMessageSend(m.ChannelID, "Failed to create tag, error: "+result)
 	} else {
@@ -1384,25 +1896,30 @@ func playList(s *discordgo.Session, m *discordgo.MessageCreate, g *discordgo.Gui
 		url = "api.soundcloud.com/tracks/"
 	}
 
-	ytdl := exec.Command("youtube-dl", "-i", "--get-id", qLink)
-	ytdlout, err := ytdl.StdoutPipe()
-	if err != nil {
-		log.Println("ytdl StdoutPipe err:", err)
-		return
-	}
-
-	r := bufio.NewReaderSize(ytdlout, 1024)
-	if err = ytdl.Start(); err != nil {
-		log.Println("ytdl Start err:", err)
+	ytdl := newPipeline(context.Background())
+	ytdl.add("youtube-dl", "-i", "--get-id", qLink)
+	if err := ytdl.start(); err != nil {
+		log.Println("ytdl start err:", err)
 		return
 	}
+	// Killed if we stop reading early, and reaped either way
+	defer ytdl.close()
+	r := bufio.NewReaderSize(ytdl, 1024)
 
 	qCount := 0
 	message, _ := s.ChannelMessageSend(m.ChannelID, "Queuing "+qLink+" Playlist"+strings.Repeat(".", (qCount%3)+1)+" Length: "+strconv.Itoa(qCount))
 
+	// If someone clears the queue while we're still going, stop queuing
+	player := getPlayer(g.ID)
+	generation := player.Generation()
+
 	// TODO: Replace with something faster/nicer
 	id, err := readln(r)
 	for err == nil {
+		if player.Generation() != generation {
+			s.ChannelMessageEdit(m.ChannelID, message.ID, "Stopped queuing "+qLink+" Playlist after "+strconv.Itoa(qCount))
+			return
+		}
 		vidLink := url + id
 		fmt.Println(vidLink)
 		playLink(s, m, g, vidLink, true)
@@ -1410,6 +1927,9 @@ func playList(s *discordgo.Session, m *discordgo.MessageCreate, g *discordgo.Gui
 		id, err = readln(r)
 		s.ChannelMessageEdit(m.ChannelID, message.ID, "Queuing "+qLink+" Playlist"+strings.Repeat(".", (qCount%3)+1)+" Length: "+strconv.Itoa(qCount))
 	}
+	if err = ytdl.wait(); err != nil {
+		log.Println("playlist err:", err)
+	}
 	s.ChannelMessageEdit(m.ChannelID, message.ID, "Queuing "+qLink+" Playlist! Length: "+strconv.Itoa(qCount))
 }
 
@@ -1501,6 +2021,8 @@ func handleBotControlMessages(s *discordgo.Session, m *discordgo.MessageCreate,
 	var merr error
 	if len(parts) == 1 {
 		message, merr = s.ChannelMessageSend(m.ChannelID, "What you want?")
+	} else if scontains("q", parts[1]) && len(parts) == 2 && len(m.Attachments) > 0 {
+		playAttachment(s, m, g)
 	} else if scontains("q", parts[1]) && len(parts) == 3 {
 		playLink(s, m, g, cleanLink(parts[2]), false)
 	} else if scontains("q", parts[1]) && len(parts) > 3 {
@@ -1538,12 +2060,23 @@ func handleBotControlMessages(s *discordgo.Session, m *discordgo.MessageCreate,
 			return
 		}
 		links := searchYtForMutliPlay(s, m, g, strings.Join(parts[3:], " "), num)
+		player := getPlayer(g.ID)
+		generation := player.Generation()
 		for _, link := range links {
+			if player.Generation() != generation {
+				break
+			}
 			playLink(s, m, g, cleanLink(link), false)
 		}
 
 	} else if scontains("lq", parts[1]) {
-		listQueue(s, m, g)
+		page := 1
+		if len(parts) >= 3 {
+			page, _ = strconv.Atoi(parts[2])
+		}
+		listQueue(s, m, g, page)
+	} else if scontains("np", parts[1]) {
+		nowPlaying(s, m, g)
 	} else if scontains("live", parts[1]) && len(parts) == 3 {
 		id, err := getIDFromLink(parts[2])
 		if err != nil {
@@ -1555,12 +2088,177 @@ func handleBotControlMessages(s *discordgo.Session, m *discordgo.MessageCreate,
 		} else {
 			message, merr = s.ChannelMessageSend(m.ChannelID, "Nah mate, not live")
 		}
-	} else if scontains("skip", parts[1]) {
-		skip(g)
-		message, merr = s.ChannelMessageSend(m.ChannelID, "<@"+m.Author.ID+"> skipped")
-		log.Info(m.Author.ID + " skipped")
+	} else if scontains("skip", parts[1]) || scontains("voteskip", parts[1]) {
+		message, merr = s.ChannelMessageSend(m.ChannelID, votes(s, m, g))
+	} else if scontains("skipratio", parts[1]) && len(parts) == 3 && (accessLevel >= 0 || isDJ(g, m.Author.ID, m.ChannelID)) {
+		ratio, err := strconv.Atoi(strings.TrimSuffix(parts[2], "%"))
+		if err != nil || ratio < 0 || ratio > 100 {
+			s.ChannelMessageSend(m.ChannelID, "Skip ratio has to be between 0 and 100")
+			return
+		}
+		getPlayer(g.ID).UpdateSettings(func(gs *GuildSettings) {
+			gs.SkipRatio = ratio
+		})
+		saveServerSettings(g.ID)
+		message, merr = s.ChannelMessageSend(m.ChannelID, "Skips now need "+strconv.Itoa(ratio)+"% of listeners")
+	} else if scontains("rm", parts[1]) && len(parts) == 3 {
+		// Takes either a single position or a range like 5-200
+		bounds := strings.SplitN(parts[2], "-", 2)
+		from, err := strconv.Atoi(bounds[0])
+		to := from
+		if err == nil && len(bounds) == 2 {
+			to, err = strconv.Atoi(bounds[1])
+		}
+		if err != nil {
+			s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error())
+			return
+		}
+		// Everyone can take back what they queued, only DJs anything else
+		var only string
+		if accessLevel < 0 && !isDJ(g, m.Author.ID, m.ChannelID) {
+			only = m.Author.ID
+		}
+		removed, err := getPlayer(g.ID).Remove(from, to, only)
+		if err != nil {
+			s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error())
+			return
+		}
+		message, merr = s.ChannelMessageSend(m.ChannelID, "Removed "+strconv.Itoa(removed)+" from the queue")
+	} else if scontains("move", parts[1]) && len(parts) == 4 && (accessLevel >= 0 || isDJ(g, m.Author.ID, m.ChannelID)) {
+		from, err := strconv.Atoi(parts[2])
+		if err != nil {
+			s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error())
+			return
+		}
+		to, err := strconv.Atoi(parts[3])
+		if err != nil {
+			s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error())
+			return
+		}
+		if getPlayer(g.ID).Move(from, to) {
+			message, merr = s.ChannelMessageSend(m.ChannelID, "Moved "+parts[2]+" to "+parts[3])
+		} else {
+			message, merr = s.ChannelMessageSend(m.ChannelID, "That's not in the queue")
+		}
+	} else if scontains("shuffle", parts[1]) && (accessLevel >= 0 || isDJ(g, m.Author.ID, m.ChannelID)) {
+		getPlayer(g.ID).Shuffle()
+		message, merr = s.ChannelMessageSend(m.ChannelID, "Shuffled the queue")
+	} else if scontains("clear", parts[1]) && (accessLevel >= 0 || isDJ(g, m.Author.ID, m.ChannelID)) {
+		cleared := getPlayer(g.ID).Clear()
+		message, merr = s.ChannelMessageSend(m.ChannelID, "<@"+m.Author.ID+"> cleared "+strconv.Itoa(cleared)+" from the queue")
+		log.Info(m.Author.ID + " cleared the queue")
+	} else if scontains("skipto", parts[1]) && len(parts) == 3 {
+		n, err := strconv.Atoi(parts[2])
+		if err != nil {
+			s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error())
+			return
+		}
+		var only string
+		if accessLevel < 0 && !isDJ(g, m.Author.ID, m.ChannelID) {
+			only = m.Author.ID
+		}
+		if ok, err := getPlayer(g.ID).SkipTo(n, only); err != nil {
+			s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error())
+			return
+		} else if ok {
+			message, merr = s.ChannelMessageSend(m.ChannelID, "<@"+m.Author.ID+"> skipped to "+parts[2])
+		} else {
+			message, merr = s.ChannelMessageSend(m.ChannelID, "That's not in the queue")
+		}
+	} else if scontains("seek", parts[1]) && len(parts) == 3 && (accessLevel >= 0 || isDJ(g, m.Author.ID, m.ChannelID) || queuedCurrent(g.ID, m.Author.ID)) {
+		// Either somewhere in the track like 1:23 or 90s, or relative like +10s
+		var (
+			offset   time.Duration
+			relative = strings.HasPrefix(parts[2], "+") || strings.HasPrefix(parts[2], "-")
+			ok       bool
+			err      error
+		)
+		if relative {
+			offset, err = time.ParseDuration(parts[2])
+		} else if offset, ok = parseDuration(parts[2]); !ok {
+			if offset, err = time.ParseDuration(parts[2]); err != nil {
+				err = errors.New("can't seek to " + parts[2])
+			}
+		}
+		if err != nil {
+			s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error())
+			return
+		}
+		if getPlayer(g.ID).Seek(offset, relative) {
+			message, merr = s.ChannelMessageSend(m.ChannelID, "<@"+m.Author.ID+"> seeked "+parts[2])
+		} else {
+			message, merr = s.ChannelMessageSend(m.ChannelID, "Nothing is playing")
+		}
+	} else if scontains("loop", parts[1]) && (len(parts) == 2 || len(parts) == 3 && (accessLevel >= 0 || isDJ(g, m.Author.ID, m.ChannelID))) {
+		player := getPlayer(g.ID)
+		if len(parts) == 2 {
+			message, merr = s.ChannelMessageSend(m.ChannelID, "Loop mode: "+player.Settings().Repeat.String())
+		} else if repeat, ok := parseRepeatMode(parts[2]); ok {
+			player.UpdateSettings(func(gs *GuildSettings) {
+				gs.Repeat = repeat
+			})
+			saveServerSettings(g.ID)
+			message, merr = s.ChannelMessageSend(m.ChannelID, "Loop mode: "+repeat.String())
+		} else {
+			message, merr = s.ChannelMessageSend(m.ChannelID, "Loop modes: `off` `track` `queue` `autoplay`")
+		}
+	} else if scontains("autoplay", parts[1]) && (accessLevel >= 0 || isDJ(g, m.Author.ID, m.ChannelID)) {
+		settings := getPlayer(g.ID).UpdateSettings(func(gs *GuildSettings) {
+			if gs.Repeat == RepeatAutoplay {
+				gs.Repeat = RepeatOff
+			} else {
+				gs.Repeat = RepeatAutoplay
+			}
+		})
+		saveServerSettings(g.ID)
+		if settings.Repeat == RepeatAutoplay {
+			message, merr = s.ChannelMessageSend(m.ChannelID, "Autoplay enabled")
+		} else {
+			message, merr = s.ChannelMessageSend(m.ChannelID, "Autoplay disabled")
+		}
+	} else if scontains("volume", parts[1]) && (len(parts) == 2 || len(parts) == 3 && (accessLevel >= 0 || isDJ(g, m.Author.ID, m.ChannelID))) {
+		player := getPlayer(g.ID)
+		if len(parts) == 2 {
+			message, merr = s.ChannelMessageSend(m.ChannelID, "Volume: "+strconv.Itoa(player.Settings().Volume)+"%")
+		} else {
+			volume, err := strconv.Atoi(strings.TrimSuffix(parts[2], "%"))
+			if err != nil || volume < 0 || volume > 200 {
+				s.ChannelMessageSend(m.ChannelID, "Volume has to be between 0 and 200")
+				return
+			}
+			player.UpdateSettings(func(gs *GuildSettings) {
+				gs.Volume = volume
+			})
+			saveServerSettings(g.ID)
+			message, merr = s.ChannelMessageSend(m.ChannelID, "Volume set to "+strconv.Itoa(volume)+"%, streams pick it up from the next song")
+		}
+	} else if scontains("pause", parts[1]) && (accessLevel >= 0 || isDJ(g, m.Author.ID, m.ChannelID) || queuedCurrent(g.ID, m.Author.ID)) {
+		if getPlayer(g.ID).Pause() {
+			message, merr = s.ChannelMessageSend(m.ChannelID, "<@"+m.Author.ID+"> paused")
+		} else {
+			message, merr = s.ChannelMessageSend(m.ChannelID, "Nothing to pause")
+		}
+	} else if scontains("resume", parts[1]) && (accessLevel >= 0 || isDJ(g, m.Author.ID, m.ChannelID) || queuedCurrent(g.ID, m.Author.ID)) {
+		if getPlayer(g.ID).Resume() {
+			message, merr = s.ChannelMessageSend(m.ChannelID, "<@"+m.Author.ID+"> resumed")
+		} else {
+			message, merr = s.ChannelMessageSend(m.ChannelID, "Nothing is paused")
+		}
+	} else if scontains("stop", parts[1]) && (accessLevel >= 0 || isDJ(g, m.Author.ID, m.ChannelID)) {
+		getPlayer(g.ID).Stop()
+		message, merr = s.ChannelMessageSend(m.ChannelID, "<@"+m.Author.ID+"> stopped")
+		log.Info(m.Author.ID + " stopped")
+	} else if scontains(parts[1], "move", "shuffle", "clear", "stop") {
+		// Whoever isn't a DJ gets to vote skip instead
+		message, merr = s.ChannelMessageSend(m.ChannelID, "Only DJs can "+parts[1]+" the queue, use `skip` to vote")
+	} else if scontains(parts[1], "seek", "pause", "resume") {
+		message, merr = s.ChannelMessageSend(m.ChannelID, "Only DJs or whoever queued this song can "+parts[1]+" it")
+	} else if scontains(parts[1], "loop", "autoplay", "volume") {
+		message, merr = s.ChannelMessageSend(m.ChannelID, "Only DJs can change "+parts[1])
 	} else if scontains("t", parts[1]) && len(parts) >= 3 {
 		playTag(s, m, g, strings.Join(parts[2:], "_"))
+	} else if scontains("ct", parts[1]) && len(parts) >= 3 && len(m.Attachments) > 0 {
+		tagAttachment(s, m, g, strings.Join(parts[2:], "_"))
 	} else if scontains("ct", parts[1]) && len(parts) >= 4 {
 		tagLink(s, m, g, strings.Join(parts[2:len(parts)-1], "_"), parts[len(parts)-1])
 	} else if scontains("mt", parts[1]) && len(parts) < 3 {
@@ -1587,21 +2285,53 @@ func handleBotControlMessages(s *discordgo.Session, m *discordgo.MessageCreate,
 	} else if scontains("pf", parts[1]) && len(parts) == 3 && accessLevel >= 0 {
 		playFile(s, m, g, parts[2])
 	} else if scontains("memepost", parts[1]) && len(parts) == 2 && accessLevel >= 0 {
-		gifPosting[g.ID] = !gifPosting[g.ID]
-		if gifPosting[g.ID] {
+		settings := getPlayer(g.ID).UpdateSettings(func(gs *GuildSettings) {
+			gs.GifPosting = !gs.GifPosting
+		})
+		if settings.GifPosting {
 			message, merr = s.ChannelMessageSend(m.ChannelID, "MEMEPOSTING ENGAGED")
 		} else {
 			message, merr = s.ChannelMessageSend(m.ChannelID, "The cancer has stopped...\nat least for now...")
 		}
 		saveServerSettings(g.ID)
 	} else if scontains("memevoice", parts[1]) && len(parts) == 2 && accessLevel >= 0 {
-		memeVoice[g.ID] = !memeVoice[g.ID]
-		if memeVoice[g.ID] {
+		settings := getPlayer(g.ID).UpdateSettings(func(gs *GuildSettings) {
+			gs.MemeVoice = !gs.MemeVoice
+		})
+		if settings.MemeVoice {
 			message, merr = s.ChannelMessageSend(m.ChannelID, "MEMEVOICE ENGAGED, !BEES TO FUCK SHIT UP")
 		} else {
 			message, merr = s.ChannelMessageSend(m.ChannelID, "The cancer voice has stopped...\nat least for now...")
 		}
 		saveServerSettings(g.ID)
+	} else if scontains("mememix", parts[1]) && len(parts) == 2 && (accessLevel >= 0 || isDJ(g, m.Author.ID, m.ChannelID)) {
+		settings := getPlayer(g.ID).UpdateSettings(func(gs *GuildSettings) {
+			gs.MemeMix = !gs.MemeMix
+		})
+		if settings.MemeMix {
+			message, merr = s.ChannelMessageSend(m.ChannelID, "Memes now get mixed over the music")
+		} else {
+			message, merr = s.ChannelMessageSend(m.ChannelID, "Memes now interrupt the music")
+		}
+		saveServerSettings(g.ID)
+	} else if scontains("recording", parts[1]) && len(parts) == 2 && (accessLevel >= 0 || isDJ(g, m.Author.ID, m.ChannelID)) {
+		player := getPlayer(g.ID)
+		player.SetRecording(!player.Settings().Recording)
+		if player.Settings().Recording {
+			s.ChannelMessageSend(m.ChannelID, "Recording is on. I'll keep the last "+durationFormat(RECORDLENGTH)+" of voice in memory while I'm in a channel, so anyone can save it with `clip <name>`")
+		} else {
+			s.ChannelMessageSend(m.ChannelID, "Recording is off, everything recorded so far has been thrown away")
+		}
+		saveServerSettings(g.ID)
+	} else if scontains("clip", parts[1]) && len(parts) >= 3 {
+		window := RECORDLENGTH
+		if seconds, err := strconv.Atoi(parts[2]); err == nil && len(parts) >= 4 {
+			if d := time.Duration(seconds) * time.Second; d > 0 && d < window {
+				window = d
+			}
+			parts = append(parts[:2], parts[3:]...)
+		}
+		clipVoice(s, m, g, window, strings.Join(parts[2:], "_"))
 	} else if scontains("ytdlupdate", parts[1]) && len(parts) == 2 && accessLevel >= 0 {
 		updateMessage := updateYTDL(s, m, g)
 		s.ChannelMessageSend(m.ChannelID, updateMessage)
@@ -1609,13 +2339,25 @@ func handleBotControlMessages(s *discordgo.Session, m *discordgo.MessageCreate,
 		verMessage := verCheckYTDL(s, m, g)
 		s.ChannelMessageSend(m.ChannelID, verMessage)
 	} else if scontains("cache", parts[1]) && len(parts) == 2 && accessLevel >= 0 {
-		caching[g.ID] = !caching[g.ID]
-		if caching[g.ID] {
+		settings := getPlayer(g.ID).UpdateSettings(func(gs *GuildSettings) {
+			gs.Caching = !gs.Caching
+		})
+		if settings.Caching {
 			message, merr = s.ChannelMessageSend(m.ChannelID, "Caching enabled")
 		} else {
 			message, merr = s.ChannelMessageSend(m.ChannelID, "Caching disabled")
 		}
 		saveServerSettings(g.ID)
+	} else if scontains("normalize", parts[1]) && len(parts) == 2 && (accessLevel >= 0 || isDJ(g, m.Author.ID, m.ChannelID)) {
+		settings := getPlayer(g.ID).UpdateSettings(func(gs *GuildSettings) {
+			gs.Normalize = !gs.Normalize
+		})
+		if settings.Normalize {
+			message, merr = s.ChannelMessageSend(m.ChannelID, "Normalization enabled")
+		} else {
+			message, merr = s.ChannelMessageSend(m.ChannelID, "Normalization disabled")
+		}
+		saveServerSettings(g.ID)
 	} else if scontains("memetimeout", parts[1]) && len(parts) == 3 && accessLevel >= 0 {
 		newTimeout, err := time.ParseDuration(parts[2])
 		if err != nil {
@@ -1623,7 +2365,9 @@ func handleBotControlMessages(s *discordgo.Session, m *discordgo.MessageCreate,
 			log.Info(err)
 			return
 		}
-		memeTimeout[g.ID] = newTimeout
+		getPlayer(g.ID).UpdateSettings(func(gs *GuildSettings) {
+			gs.MemeTimeout = newTimeout
+		})
 		saveServerSettings(g.ID)
 
 	} else if scontains("servers", parts[1]) && accessLevel == 1 {
@@ -1637,6 +2381,17 @@ func handleBotControlMessages(s *discordgo.Session, m *discordgo.MessageCreate,
 			log.Info(err)
 		}
 
+	} else if scontains("fsck", parts[1]) && accessLevel == 1 {
+		message, merr = s.ChannelMessageSend(m.ChannelID, "Checking audio files...")
+		go func() {
+			checks, err := checkAudio(true)
+			if err != nil {
+				s.ChannelMessageSend(m.ChannelID, "Couldn't check audio files: "+err.Error())
+				return
+			}
+			s.ChannelMessageSend(m.ChannelID, audioReport(checks))
+		}()
+
 	} else if scontains("status", parts[1]) {
 		displayBotStats(m.ChannelID)
 	} else if scontains("stats", parts[1]) {
@@ -1668,7 +2423,7 @@ func handleBotControlMessages(s *discordgo.Session, m *discordgo.MessageCreate,
 		message, merr = s.ChannelMessageSend(m.ChannelID, "Name: `"+title+"`\nID: `"+id+"`\nDuration: `"+timeFormat(duration)+"`\nLatency:`"+latency+"`")
 	} else if scontains("help", parts[1]) {
 		s.ChannelMessageSend(m.ChannelID, "`@AirGoat cmd`")
-		s.ChannelMessageSend(m.ChannelID, "Command list: `q` - Queues a YouTube or SoundCloud link\n`pl` - Queues a YouTube or SoundCloud playlist\n`t` - Queues a tag\n`ct` - Creates a tag\n`mt` - Queues multiple tags\n`skip` - Skips current song\n`help` - This")
+		s.ChannelMessageSend(m.ChannelID, "Command list: `q` - Queues a YouTube or SoundCloud link, or an attached audio file\n`pl` - Queues a YouTube or SoundCloud playlist\n`t` - Queues a tag\n`ct` - Creates a tag from a link or an attached audio file\n`mt` - Queues multiple tags\n`skip` - Skips current song, or votes to if you didn't queue it\n`skipratio` - Sets the percentage of listeners needed to vote skip\n`lq` - Lists the queue, `lq 2` for the next page\n`np` - Shows what's playing\n`rm` - Removes a queue entry or range you queued, `rm 3` or `rm 5-200`, DJs can remove anything\n`move` - Moves a queue entry, `move 5 1` (DJs)\n`shuffle` - Shuffles the queue (DJs)\n`clear` - Clears the queue (DJs)\n`skipto` - Skips to a queue entry past your own plays, DJs past anything\n`stop` - Clears the queue and leaves (DJs)\n`loop` - Sets the loop mode, `loop track`, `loop queue` or `loop off` (DJs)\n`autoplay` - Toggles playing cached tracks once the queue is empty (DJs)\n`volume` - Sets the volume from 0 to 200, `volume 50` (DJs)\n`mememix` - Toggles mixing memes over the music instead of interrupting it\n`recording` - Toggles keeping the last few seconds of voice for `clip`\n`clip` - Saves the last few seconds of voice as a tag, `clip name` or `clip 10 name`\n`pause` - Pauses the current song (DJs or whoever queued it)\n`seek` - Seeks in the current song, `seek 1:23` or `seek +10s` (DJs or whoever queued it)\n`resume` - Resumes a paused song (DJs or whoever queued it)\n`help` - This")
 		//s.ChannelMessageSend(m.ChannelID, "`master @AirGoat cmd`")
 		//s.ChannelMessageSend(m.ChannelID, "Command list: `del` `delTag` `delLink` `pf` `gifpost` `cache` `servers` `leave`")
 	} else {
@@ -1683,7 +2438,7 @@ func handleBotControlMessages(s *discordgo.Session, m *discordgo.MessageCreate,
 }
 
 func gifPost(s *discordgo.Session, m *discordgo.MessageCreate, g *discordgo.Guild) {
-	if time.Now().Before(lastMeme[g.ID].Add(memeTimeout[g.ID])) {
+	if !getPlayer(g.ID).claimMeme() {
 		log.Info("too soon")
 		return
 	}
@@ -1714,8 +2469,6 @@ func gifPost(s *discordgo.Session, m *discordgo.MessageCreate, g *discordgo.Guil
 			s.ChannelMessageSend(m.ChannelID, meme)
 		}
 	}
-
-	lastMeme[g.ID] = time.Now()
 }
 
 func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
@@ -1743,7 +2496,8 @@ func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 		return
 	}
 
-	if gifPosting[guild.ID] && m.Author.ID != s.State.User.ID {
+	settings := getPlayer(guild.ID).Settings()
+	if settings.GifPosting && m.Author.ID != s.State.User.ID {
 		go gifPost(s, m, guild)
 	}
 
@@ -1772,7 +2526,7 @@ func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 
 	// Find the collection for the command we got
 	for _, coll := range COLLECTIONS {
-		if scontains(parts[0], coll.Commands...) && memeVoice[guild.ID] == true {
+		if scontains(parts[0], coll.Commands...) && settings.MemeVoice {
 
 			// If they passed a specific sound effect, find and select that (otherwise play nothing)
 			var sound *Sound
@@ -1788,6 +2542,7 @@ func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 				}
 			}
 
+			getPlayer(guild.ID).SetTextChannel(m.ChannelID)
 			go enqueuePlay(m.Author, guild, coll, sound)
 			return
 		}
@@ -1874,7 +2629,8 @@ func saveServerSettings(guildID string) {
 		log.Info("server settings save err: ", err)
 		return
 	}
-	n, err := f.WriteString(toCSV(strconv.FormatBool(gifPosting[guildID]), strconv.FormatBool(caching[guildID]), memeTimeout[guildID].String(), strconv.FormatBool(memeVoice[guildID])))
+	settings := getPlayer(guildID).Settings()
+	n, err := f.WriteString(toCSV(strconv.FormatBool(settings.GifPosting), strconv.FormatBool(settings.Caching), settings.MemeTimeout.String(), strconv.FormatBool(settings.MemeVoice), settings.Repeat.String(), strconv.Itoa(settings.SkipRatio), strconv.Itoa(settings.Volume), strconv.FormatBool(settings.Normalize), strconv.FormatBool(settings.MemeMix), strconv.FormatBool(settings.Recording)))
 	log.Info(n, err)
 	f.Sync()
 	f.Close()
@@ -1890,10 +2646,9 @@ func toCSV(args ...string) string {
 }
 
 func initServerSettings(guildID string) {
-	gifPosting[guildID] = false
-	caching[guildID] = false
-	memeTimeout[guildID], _ = time.ParseDuration("0s")
-	memeVoice[guildID] = true
+	getPlayer(guildID).UpdateSettings(func(gs *GuildSettings) {
+		*gs = defaultSettings()
+	})
 
 	f, err := os.Create("sconfigs/" + guildID + ".csv")
 	if err != nil {
@@ -1943,26 +2698,71 @@ func loadServerSettings(guildID string) {
 			log.Info("invalid settings length")
 			return
 		}
-		gifPosting[guildID], err = strconv.ParseBool(record[0])
+		var settings GuildSettings
+		settings.GifPosting, err = strconv.ParseBool(record[0])
 		if err != nil {
-			gifPosting[guildID] = false
+			settings.GifPosting = false
 			log.Info(err)
 		}
-		caching[guildID], err = strconv.ParseBool(record[1])
+		settings.Caching, err = strconv.ParseBool(record[1])
 		if err != nil {
-			caching[guildID] = false
+			settings.Caching = false
 			log.Info(err)
 		}
-		memeTimeout[guildID], err = time.ParseDuration(record[2])
+		settings.MemeTimeout, err = time.ParseDuration(record[2])
 		if err != nil {
-			memeTimeout[guildID], _ = time.ParseDuration("0s")
+			settings.MemeTimeout, _ = time.ParseDuration("0s")
 			log.Info(err)
 		}
-		memeVoice[guildID], err = strconv.ParseBool(record[3])
+		settings.MemeVoice, err = strconv.ParseBool(record[3])
 		if err != nil {
-			memeVoice[guildID] = true
+			settings.MemeVoice = true
 			log.Info(err)
 		}
+		// Settings saved by older versions stop early
+		if len(record) > 4 {
+			settings.Repeat, _ = parseRepeatMode(record[4])
+		}
+		settings.SkipRatio = defaultSettings().SkipRatio
+		if len(record) > 5 {
+			settings.SkipRatio, err = strconv.Atoi(record[5])
+			if err != nil {
+				settings.SkipRatio = defaultSettings().SkipRatio
+				log.Info(err)
+			}
+		}
+		settings.Volume = defaultSettings().Volume
+		if len(record) > 6 {
+			settings.Volume, err = strconv.Atoi(record[6])
+			if err != nil {
+				settings.Volume = defaultSettings().Volume
+				log.Info(err)
+			}
+		}
+		if len(record) > 7 {
+			settings.Normalize, err = strconv.ParseBool(record[7])
+			if err != nil {
+				settings.Normalize = false
+				log.Info(err)
+			}
+		}
+		if len(record) > 8 {
+			settings.MemeMix, err = strconv.ParseBool(record[8])
+			if err != nil {
+				settings.MemeMix = false
+				log.Info(err)
+			}
+		}
+		if len(record) > 9 {
+			settings.Recording, err = strconv.ParseBool(record[9])
+			if err != nil {
+				settings.Recording = false
+				log.Info(err)
+			}
+		}
+		getPlayer(guildID).UpdateSettings(func(gs *GuildSettings) {
+			*gs = settings
+		})
 	}
 }
 
@@ -2044,6 +2844,12 @@ func verCheckYTDL(s *discordgo.Session, m *discordgo.MessageCreate, g *discordgo
 }
 
 func main() {
+	// bot import ... converts audio files for the soundboard instead of
+	// running the bot
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(importMain(os.Args[2:]))
+	}
+
 	var (
 		Token      = flag.String("t", "", "Discord Authentication Token")
 		Redis      = flag.String("r", "", "Redis Connection String")
@@ -2053,8 +2859,28 @@ func main() {
 		YtAPIKey   = flag.String("y", "", "Youtube API Key")
 		err        error
 	)
+	flag.StringVar(&ENCODER, "enc", ENCODER, "Opus encoder, \"gopus\" to encode in process or the path to a dca binary")
+	flag.DurationVar(&PIPESTARTTIMEOUT, "pst", PIPESTARTTIMEOUT, "How long youtube-dl/ffmpeg get to start producing audio, 0 for forever")
+	flag.DurationVar(&PIPEIDLETIMEOUT, "pit", PIPEIDLETIMEOUT, "How long youtube-dl/ffmpeg output can stall, 0 for forever")
+	flag.IntVar(&PREFETCHBYTES, "pb", PREFETCHBYTES, "Bytes of the next stream to buffer while the current one plays, 0 to disable")
+	flag.DurationVar(&PREFETCHAHEAD, "pa", PREFETCHAHEAD, "How long before the end of a song to start buffering the next")
+	flag.DurationVar(&PAUSETIMEOUT, "pt", PAUSETIMEOUT, "How long playback can stay paused, 0 for forever")
+	flag.BoolVar(&PAUSERESUME, "pr", PAUSERESUME, "Resume instead of leaving the channel when a pause times out")
+	flag.IntVar(&ATTACHMENTMAXBYTES, "amb", ATTACHMENTMAXBYTES, "Biggest uploaded file that gets played, in bytes, 0 for no limit")
+	flag.DurationVar(&ATTACHMENTMAXLENGTH, "aml", ATTACHMENTMAXLENGTH, "Longest uploaded file that gets played, 0 for no limit")
+	flag.IntVar(&CACHEBYTES, "cb", CACHEBYTES, "Bytes of short sounds to keep in memory, 0 to read everything off disk")
+	flag.IntVar(&CACHECLIPBYTES, "ccb", CACHECLIPBYTES, "Biggest sound file to keep in memory, bigger ones are read off disk as they play")
+	flag.DurationVar(&RECORDLENGTH, "rl", RECORDLENGTH, "How much voice to keep for clip in guilds that turned recording on")
+	flag.DurationVar(&JITTERDEPTH, "jd", JITTERDEPTH, "How much audio to buffer ahead of playback, 0 to disable")
+	flag.IntVar(&STREAMRETRIES, "sr", STREAMRETRIES, "How many times a stream that drops before its end gets resumed")
+	flag.BoolVar(&AUDIOCHECK, "ac", AUDIOCHECK, "Check audio/ for broken files at startup")
+	flag.BoolVar(&AUDIOREPAIR, "ar", AUDIOREPAIR, "Truncate files with a broken end and quarantine unreadable ones during the startup check, -ar=false only reports them")
+	flag.IntVar(&FAILLIMIT, "fl", FAILLIMIT, "How many times a link can fail to play before it stops getting retried")
+	flag.DurationVar(&FAILMEMORY, "fm", FAILMEMORY, "How long a link failing to play is remembered for")
 	flag.Parse()
 
+	encoder = newEncoder(ENCODER)
+
 	if *Owner != "" {
 		OWNER = *Owner
 	}
@@ -2065,10 +2891,23 @@ func main() {
 		log.Info("WARNING! You have not provided a YouTube API Key .. @AirGoat live function will not work correctly .. Caching is dangerous as Live YouTube videos are not checked")
 	}
 
-	// Preload all the sounds
-	log.Info("Preloading sounds...")
+	cleanAttachments()
+
+	// Anything cut short by a crash would otherwise be a cache hit forever
+	if AUDIOCHECK {
+		log.Info("Checking audio files...")
+		if checks, err := checkAudio(AUDIOREPAIR); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warning("Failed to check audio files")
+		} else {
+			log.Info(audioReport(checks))
+		}
+	}
+
+	// Sounds are read as they play, this only checks they're all there
 	for _, coll := range COLLECTIONS {
-		coll.Load()
+		coll.Init()
 	}
 
 	// If we got passed a redis server, try to connect
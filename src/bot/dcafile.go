@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"dca"
+)
+
+// Metadata for a file we're about to encode with the current settings
+func newDCAMetadata(title, source, url, creator string) *dca.Metadata {
+	return &dca.Metadata{
+		DCA: dca.ToolInfo{
+			Version: 1,
+			Tool:    "airgoat",
+		},
+		Opus: dca.OpusInfo{
+			Mode:       "audio",
+			SampleRate: opusSampleRate,
+			FrameSize:  opusFrameSize,
+			Bitrate:    BITRATE,
+			Channels:   opusChannels,
+		},
+		Info:   dca.SongInfo{Title: title},
+		Origin: dca.Origin{Source: source, URL: url},
+		Extra: dca.Extra{
+			Creator: creator,
+			Encoder: ENCODER,
+		},
+	}
+}
+
+// Metadata of a file in audio/, nil if it's a legacy one
+func readDCAMetadata(name string) (*dca.Metadata, error) {
+	file, err := os.Open("audio/" + name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	dr, err := dca.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	return dr.Metadata, nil
+}
+
+// Writes frames to path as a DCA1 file, going through a temporary file so a
+// half written one never shows up under path
+func writeDCAFile(path string, meta *dca.Metadata, frames [][]byte) error {
+	meta.SetDuration(len(frames))
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriterSize(tmp, 16384)
+	dw, err := dca.NewWriter(w, meta)
+	if err != nil {
+		return err
+	}
+	for _, opus := range frames {
+		if err = dw.WriteFrame(opus); err != nil {
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Saves the raw frames coming out of r to path as a DCA1 file. Since the
+// header needs the length up front, the frames are spooled to a temporary
+// file first. done gets the final say before anything shows up under path.
+func saveDCA(r io.Reader, path string, meta *dca.Metadata, done func() error) error {
+	spool, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".raw")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	in := dca.NewRawReader(r)
+	out := bufio.NewWriterSize(spool, 16384)
+	dw, _ := dca.NewWriter(out, nil)
+	for {
+		opus, err := in.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err = dw.WriteFrame(opus); err != nil {
+			return err
+		}
+	}
+	if err = out.Flush(); err != nil {
+		return err
+	}
+	if done != nil {
+		if err = done(); err != nil {
+			return err
+		}
+	}
+	if dw.Frames() == 0 {
+		return errors.New("no audio")
+	}
+	meta.SetDuration(dw.Frames())
+
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriterSize(tmp, 16384)
+	if err = dca.WriteHeader(w, meta); err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, spool); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os/exec"
+
+	"dca"
+
+	"github.com/layeh/gopus"
+)
+
+// Encoder - Turns 48kHz stereo s16le PCM into raw dca, opus frames each
+// prefixed with their int16 length
+type Encoder interface {
+	// Encode reads pcm until it runs out, writing every frame to out. It
+	// gives up once ctx is done.
+	Encode(ctx context.Context, pcm io.Reader, out io.Writer) error
+}
+
+// Encoder everything goes through, picked by the -enc flag
+var encoder Encoder = opusEncoder{}
+
+// Encoder for the name given to -enc, "gopus" encodes in process and anything
+// else is taken as the path to a dca binary
+func newEncoder(name string) Encoder {
+	if name == "gopus" {
+		return opusEncoder{}
+	}
+	return execEncoder{path: name}
+}
+
+// Runs the dca binary over the PCM, like we always used to
+type execEncoder struct {
+	path string
+}
+
+func (e execEncoder) Encode(ctx context.Context, pcm io.Reader, out io.Writer) error {
+	var stderr tailBuffer
+	cmd := exec.CommandContext(ctx, e.path, "-raw", "-i", "pipe:0")
+	cmd.Stdin = pcm
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if tail := stderr.String(); tail != "" {
+			return fmt.Errorf("dca Run err: %v: %s", err, tail)
+		}
+		return fmt.Errorf("dca Run err: %v", err)
+	}
+	return nil
+}
+
+// Encodes with libopus right here, saving a process per play
+type opusEncoder struct{}
+
+func (opusEncoder) Encode(ctx context.Context, pcm io.Reader, out io.Writer) error {
+	enc, err := gopus.NewEncoder(opusSampleRate, opusChannels, gopus.Audio)
+	if err != nil {
+		return err
+	}
+	enc.SetBitrate(BITRATE * 1000)
+	dw, _ := dca.NewWriter(out, nil)
+
+	raw := make([]byte, opusFrameSize*opusChannels*2)
+	samples := make([]int16, opusFrameSize*opusChannels)
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := io.ReadFull(pcm, raw)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		// Pad a short last frame out with silence
+		for i := n; i < len(raw); i++ {
+			raw[i] = 0
+		}
+		for i := range samples {
+			samples[i] = int16(binary.LittleEndian.Uint16(raw[i*2:]))
+		}
+
+		opus, err := enc.Encode(samples, opusFrameSize, opusMaxBytes)
+		if err != nil {
+			return fmt.Errorf("opus encode err: %v", err)
+		}
+
+		if err = dw.WriteFrame(opus); err != nil {
+			return err
+		}
+
+		if n < len(raw) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+)
+
+// What youtube-dl says when it won't hand over a video, and what we tell
+// people instead. Matched against the lowercased error.
+var failureReasons = []struct {
+	match  string
+	reason string
+}{
+	{"not available in your country", "geo-blocked"},
+	{"geo restriction", "geo-blocked"},
+	{"geo-restricted", "geo-blocked"},
+	{"private video", "private video"},
+	{"video is private", "private video"},
+	{"confirm your age", "age-restricted"},
+	{"age-restricted", "age-restricted"},
+	{"age restricted", "age-restricted"},
+	{"unsupported url", "unsupported URL"},
+	{"video unavailable", "video unavailable"},
+	{"video is unavailable", "video unavailable"},
+	{"has been removed", "video removed"},
+	{"http error 404", "not found"},
+}
+
+// Short reason a play failed, fit for chat
+func failureReason(err error) string {
+	msg := strings.ToLower(err.Error())
+	for _, fr := range failureReasons {
+		if strings.Contains(msg, fr.match) {
+			return fr.reason
+		}
+	}
+
+	perr, ok := err.(*PipelineError)
+	if !ok {
+		return err.Error()
+	}
+	if perr.Err == errStartTimeout || perr.Err == errIdleTimeout {
+		return "timed out"
+	}
+	switch perr.Stage {
+	case "youtube-dl":
+		return "youtube-dl couldn't download it"
+	case "ffmpeg":
+		return "couldn't decode the audio"
+	}
+	return stageError(err)
+}
+
+// A link that failed to play recently
+type linkFailure struct {
+	count  int
+	reason string
+	last   time.Time
+}
+
+var (
+	failures   = make(map[string]*linkFailure)
+	failuresMu sync.Mutex
+)
+
+// Remembers that link failed to play for reason
+func recordFailure(link, reason string) {
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+
+	f := failures[link]
+	if f == nil || time.Since(f.last) > FAILMEMORY {
+		f = &linkFailure{}
+		failures[link] = f
+	}
+	f.count++
+	f.reason = reason
+	f.last = time.Now()
+}
+
+// Forgets about link failing, once it's played fine
+func clearFailure(link string) {
+	failuresMu.Lock()
+	delete(failures, link)
+	failuresMu.Unlock()
+}
+
+// Why link shouldn't be tried again, empty if it's fine to play
+func knownFailure(link string) string {
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+
+	f := failures[link]
+	if f == nil {
+		return ""
+	}
+	if time.Since(f.last) > FAILMEMORY {
+		delete(failures, link)
+		return ""
+	}
+	if f.count < FAILLIMIT {
+		return ""
+	}
+	return f.reason + ", failed " + strconv.Itoa(f.count) + " times recently"
+}
+
+// True if this play or any chained after it failed last time it was played
+func (p *Play) chainFailed() bool {
+	for ; p != nil; p = p.Next {
+		if p.failed {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports play failing with err, and remembers it if it was a link
+func playFailed(play *Play, err error, s ...*discordgo.Session) {
+	reason := failureReason(err)
+	log.WithFields(log.Fields{
+		"play":  play.title(),
+		"error": err,
+	}).Warning("Failed to play sound")
+
+	if link := streamLink(play); link != "" {
+		recordFailure(link, reason)
+	}
+	reportFailure(play, reason, s...)
+}
+
+// Tells the text channel play was requested from that it couldn't be played
+func reportFailure(play *Play, reason string, s ...*discordgo.Session) {
+	if play.TextChannelID == "" || len(s) == 0 {
+		return
+	}
+	s[0].ChannelMessageSend(play.TextChannelID, "Couldn't play "+play.title()+": "+reason)
+}
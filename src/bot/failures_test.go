@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A link that always fails mustn't keep a looping player going forever
+func TestFailingLinkLoops(t *testing.T) {
+	link := "https://example.com/never-plays"
+	for i := 0; i < FAILLIMIT; i++ {
+		recordFailure(link, "video unavailable")
+	}
+	defer clearFailure(link)
+
+	for _, mode := range []RepeatMode{RepeatTrack, RepeatQueue} {
+		guildID := "loop-" + mode.String()
+		player := getPlayer(guildID)
+		player.UpdateSettings(func(gs *GuildSettings) {
+			gs.Repeat = mode
+		})
+
+		play := &Play{GuildID: guildID, Sound: createSound(link+"@stream", 1, 0)}
+		player.enqueue(play)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- playSound(play, nil)
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("loop %s: %v", mode, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("loop %s: still replaying a link that always fails", mode)
+		}
+
+		if player.Playing() || player.QueueLength() != 0 {
+			t.Errorf("loop %s: player still has the failing link", mode)
+		}
+	}
+}
+
+func TestFailedPlayNotRepeated(t *testing.T) {
+	for _, mode := range []RepeatMode{RepeatTrack, RepeatQueue} {
+		player := getPlayer("repeat-" + mode.String())
+		player.UpdateSettings(func(gs *GuildSettings) {
+			gs.Repeat = mode
+		})
+
+		good := &Play{Sound: createSound("good", 1, 0)}
+		if next := player.next(good); next != good {
+			t.Errorf("loop %s: a good play wasn't repeated", mode)
+		}
+		player.pop()
+
+		bad := &Play{Sound: createSound("bad", 1, 0), failed: true}
+		if next := player.next(bad); next != nil {
+			t.Errorf("loop %s: got %v after a failed play, want nothing", mode, next)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"dca"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Where files too broken to repair end up, out of the way of the cache
+const quarantineDir = "audio/quarantine"
+
+// Most broken files fsck lists before it cuts the message short
+const fsckReportLines = 15
+
+// What checking one file in audio/ turned up
+type audioCheck struct {
+	Name     string
+	Frames   int
+	Duration time.Duration
+	Err      error
+
+	// Good frames past the damage, which playback steps over to get to
+	After int
+
+	// "truncated" or "quarantined" if it got repaired, "left alone" if the
+	// damage is in the middle, or why repairing failed
+	Action string
+}
+
+// Checks every dca file in audio/, repairing the broken ones if repair is set.
+// Files being written are left alone, they only show up under their real
+// name once they're done.
+func checkAudio(repair bool) ([]audioCheck, error) {
+	files, err := ioutil.ReadDir("audio")
+	if err != nil {
+		return nil, err
+	}
+
+	var checks []audioCheck
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".dca") {
+			continue
+		}
+
+		c, err := checkDCA(name)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"file":  name,
+				"error": err,
+			}).Warning("Failed to check dca file")
+			continue
+		}
+		if c.Err != nil && repair {
+			c.Action = repairDCA(c)
+		}
+
+		if c.Err != nil {
+			log.WithFields(log.Fields{
+				"file":     name,
+				"frames":   c.Frames,
+				"duration": c.Duration,
+				"after":    c.After,
+				"error":    c.Err,
+				"action":   c.Action,
+			}).Warning("Broken dca file")
+		} else {
+			log.WithFields(log.Fields{
+				"file":     name,
+				"frames":   c.Frames,
+				"duration": c.Duration,
+			}).Info("Checked dca file")
+		}
+		checks = append(checks, c)
+	}
+	return checks, nil
+}
+
+// Validates every frame of a file in audio/. The error is only for files that
+// can't be opened, what's wrong with the file itself goes in Err.
+func checkDCA(name string) (audioCheck, error) {
+	c := audioCheck{Name: name}
+	file, err := os.Open("audio/" + name)
+	if err != nil {
+		return c, err
+	}
+	defer file.Close()
+
+	c.Frames, c.Err = dca.Validate(file)
+	if _, ok := c.Err.(*dca.FrameError); ok {
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return c, err
+		}
+		if c.After, err = framesAfterDamage(file, c.Frames); err != nil {
+			return c, err
+		}
+	}
+	c.Duration = time.Duration(c.Frames+c.After) * FRAMEDURATION
+	return c, nil
+}
+
+// Counts the good frames in r past the first frames ones, resyncing over
+// damage the same way playback does
+func framesAfterDamage(r io.Reader, frames int) (int, error) {
+	dr, err := dca.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+
+	good := 0
+	for {
+		opus, err := dr.ReadFrame()
+		if err == nil {
+			if dca.CheckPacket(opus) == nil {
+				good++
+			}
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(*dca.FrameError); !ok {
+			return 0, err
+		}
+		if _, err = dr.Resync(); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	if good < frames {
+		return 0, nil
+	}
+	return good - frames, nil
+}
+
+// Cuts a broken file back to its last good frame if only the end of it is
+// damaged, or quarantines it if there's nothing good in it. Damage with good
+// frames after it is left for playback to step over, cutting there would
+// throw them away. Returns what was done.
+func repairDCA(c audioCheck) string {
+	if c.After > 0 {
+		return "left alone"
+	}
+
+	ferr, ok := c.Err.(*dca.FrameError)
+	if !ok || c.Frames == 0 {
+		if err := quarantineDCA(c.Name); err != nil {
+			return "quarantine failed: " + err.Error()
+		}
+		return "quarantined"
+	}
+
+	if err := truncateDCA(c.Name, c.Frames, ferr.Offset); err != nil {
+		return "truncate failed: " + err.Error()
+	}
+	return "truncated"
+}
+
+// Keeps the first frames frames of a file, which end at offset. DCA1 files get
+// written out again so their header has the new length.
+func truncateDCA(name string, frames int, offset int64) error {
+	meta, err := readDCAMetadata(name)
+	if err != nil {
+		return err
+	}
+	if meta == nil {
+		return os.Truncate("audio/"+name, offset)
+	}
+
+	file, err := os.Open("audio/" + name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	dr, err := dca.NewReader(file)
+	if err != nil {
+		return err
+	}
+	good := make([][]byte, 0, frames)
+	for len(good) < frames {
+		opus, err := dr.ReadFrame()
+		if err != nil {
+			return err
+		}
+		good = append(good, opus)
+	}
+	return writeDCAFile("audio/"+name, meta, good)
+}
+
+// Moves a file and its loudness measurements to quarantineDir
+func quarantineDCA(name string) error {
+	if err := os.MkdirAll(quarantineDir, 0755); err != nil {
+		return err
+	}
+	os.Rename(loudnessPath(name), quarantineDir+"/"+name+".json")
+	return os.Rename("audio/"+name, quarantineDir+"/"+name)
+}
+
+// Sums up a check for fsck, listing what was broken and what became of it
+func audioReport(checks []audioCheck) string {
+	var (
+		total  time.Duration
+		broken []string
+	)
+	for _, c := range checks {
+		total += c.Duration
+		if c.Err == nil {
+			continue
+		}
+		line := fmt.Sprintf("%s: %v", c.Name, c.Err)
+		if c.Frames > 0 {
+			line += ", " + durationFormat(time.Duration(c.Frames)*FRAMEDURATION) + " good"
+		}
+		if c.After > 0 {
+			line += ", " + durationFormat(time.Duration(c.After)*FRAMEDURATION) + " good after the damage"
+		}
+		if c.Action != "" {
+			line += " (" + c.Action + ")"
+		}
+		broken = append(broken, line)
+	}
+
+	report := fmt.Sprintf("Checked %d files, %s of audio, %d broken", len(checks), durationFormat(total), len(broken))
+	for i, line := range broken {
+		if i == fsckReportLines {
+			report += fmt.Sprintf("\n...and %d more, see the log", len(broken)-i)
+			break
+		}
+		report += "\n" + line
+	}
+	return report
+}
+
+// Next frame of dr that's fit to send, stepping over damaged ones instead of
+// giving up on the rest of the file. Only the end of the file or a failing
+// read stops it.
+func nextGoodFrame(dr *dca.Reader, path string) ([]byte, error) {
+	for {
+		opus, err := dr.ReadFrame()
+		if err == nil {
+			if dca.CheckPacket(opus) == nil {
+				return opus, nil
+			}
+			log.WithFields(log.Fields{
+				"file":  path,
+				"frame": dr.Frames() - 1,
+			}).Warning("Skipping bad opus packet")
+			continue
+		}
+		if _, ok := err.(*dca.FrameError); !ok {
+			return nil, err
+		}
+
+		skipped, rerr := dr.Resync()
+		log.WithFields(log.Fields{
+			"file":    path,
+			"error":   err,
+			"skipped": skipped,
+		}).Warning("Skipping damaged dca frames")
+		if rerr != nil {
+			return nil, rerr
+		}
+	}
+}
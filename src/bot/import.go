@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"dca"
+)
+
+// Cuts silence off the start, then does the same to the end by running it
+// backwards
+const trimFilter = "silenceremove=start_periods=1:start_threshold=-50dB," +
+	"areverse,silenceremove=start_periods=1:start_threshold=-50dB,areverse"
+
+// What can't go in a sound name, everything else in a file name becomes _
+var importNameStrip = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// Runs `bot import`, turning local audio files into soundboard dca files in
+// audio/ named <prefix>_<name>.dca. Returns the exit code.
+func importMain(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "Collection prefix the files are named with")
+	trim := fs.Bool("trim", false, "Cut silence off the start and end")
+	normalize := fs.Bool("normalize", false, "Even out the loudness")
+	force := fs.Bool("f", false, "Overwrite files that already exist")
+	fs.StringVar(&ENCODER, "enc", ENCODER, "Opus encoder, \"gopus\" to encode in process or the path to a dca binary")
+	fs.IntVar(&BITRATE, "b", BITRATE, "Bitrate in kbps")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bot import -prefix name [-trim] [-normalize] [-f] files or directories...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	*prefix = strings.ToLower(*prefix)
+	if *prefix == "" || importNameStrip.MatchString(*prefix) || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	encoder = newEncoder(ENCODER)
+
+	files, err := importFiles(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "no wav, mp3, ogg or flac files to import")
+		return 1
+	}
+
+	code := 0
+	var imported []string
+	for _, src := range files {
+		name := importName(src)
+		if name == "" {
+			fmt.Fprintf(os.Stderr, "%s: can't make a sound name out of that\n", src)
+			code = 1
+			continue
+		}
+		dcaName := *prefix + "_" + name + ".dca"
+		if _, err := os.Stat("audio/" + dcaName); err == nil && !*force {
+			fmt.Fprintf(os.Stderr, "%s: audio/%s already exists, -f to overwrite\n", src, dcaName)
+			code = 1
+			continue
+		}
+
+		meta := newDCAMetadata(name, "file", "", "")
+		if err := importFile(src, dcaName, meta, *trim, *normalize); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", src, err)
+			code = 1
+			continue
+		}
+		fmt.Printf("%s -> audio/%s (%s)\n", src, dcaName, durationFormat(meta.Duration()))
+		imported = append(imported, name)
+	}
+
+	if len(imported) > 0 {
+		fmt.Println("\nAdd them to a collection with:")
+		for _, name := range imported {
+			fmt.Printf("\t\tcreateSound(%q, 100, 250),\n", name)
+		}
+	}
+	return code
+}
+
+// Audio files among paths, directories get searched one level deep
+func importFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() && attachmentExts[strings.ToLower(filepath.Ext(e.Name()))] {
+				files = append(files, filepath.Join(path, e.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+// Sound name for a file, its base name lowercased with anything odd made _
+func importName(src string) string {
+	name := strings.TrimSuffix(filepath.Base(src), filepath.Ext(src))
+	name = importNameStrip.ReplaceAllString(strings.ToLower(name), "_")
+	return strings.Trim(name, "_")
+}
+
+// Encodes src into audio/dcaName through ffmpeg and the encoder, the same way
+// files get played
+func importFile(src, dcaName string, meta *dca.Metadata, trim, normalize bool) error {
+	var filters []string
+	if trim {
+		filters = append(filters, trimFilter)
+	}
+
+	var l *Loudness
+	if normalize {
+		var err error
+		if l, err = measureLoudness(src, filters...); err != nil {
+			return fmt.Errorf("loudness measure err: %v", err)
+		}
+		filters = append(filters, l.filter())
+	}
+
+	args := []string{"-i", src}
+	if filters != nil {
+		args = append(args, "-af", strings.Join(filters, ","))
+	}
+	args = append(args, "-f", "s16le", "-ar", "48000", "-ac", "2", "pipe:1")
+
+	p := newPipeline(context.Background())
+	p.add("ffmpeg", args...)
+	p.encoded()
+	if err := p.saveTo("audio/"+dcaName, meta); err != nil {
+		return err
+	}
+
+	if l != nil {
+		if err := saveLoudness(dcaName, l); err != nil {
+			return fmt.Errorf("loudness save err: %v", err)
+		}
+	}
+	return nil
+}
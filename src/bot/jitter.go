@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// How many times a jitter buffer ran dry mid-play, and how many times one sat
+// full for a whole buffer's worth without playback taking anything while not
+// paused. Shown in status.
+var (
+	jitterUnderruns int64
+	jitterOverruns  int64
+)
+
+// Frames read ahead of a streamPipe so stalls in youtube-dl or ffmpeg don't
+// reach the voice connection
+type jitterBuffer struct {
+	player *GuildPlayer
+	frames chan []byte
+	primed bool
+
+	// Why the pipe ran out, safe to read once done is closed
+	err  error
+	done chan struct{}
+	stop chan struct{}
+}
+
+// Starts reading sp into a buffer JITTERDEPTH long
+func newJitterBuffer(player *GuildPlayer, sp *streamPipe) *jitterBuffer {
+	depth := int(JITTERDEPTH / FRAMEDURATION)
+	if depth < 1 {
+		depth = 1
+	}
+
+	jb := &jitterBuffer{
+		player: player,
+		frames: make(chan []byte, depth),
+		done:   make(chan struct{}),
+		stop:   make(chan struct{}),
+	}
+	go jb.fill(sp)
+	return jb
+}
+
+func (jb *jitterBuffer) fill(sp *streamPipe) {
+	defer close(jb.done)
+	defer close(jb.frames)
+
+	held := time.NewTimer(JITTERDEPTH)
+	defer held.Stop()
+
+	for {
+		opus, err := sp.next()
+		if err != nil {
+			jb.err = err
+			return
+		}
+
+		// The pipe is usually faster than playback, so waiting on a full
+		// buffer is normal. Only playback getting stuck counts.
+		if !held.Stop() {
+			select {
+			case <-held.C:
+			default:
+			}
+		}
+		held.Reset(JITTERDEPTH)
+		select {
+		case jb.frames <- opus:
+			continue
+		case <-jb.stop:
+			return
+		case <-held.C:
+		}
+
+		if !jb.player.Paused() {
+			atomic.AddInt64(&jitterOverruns, 1)
+		}
+		select {
+		case jb.frames <- opus:
+		case <-jb.stop:
+			return
+		}
+	}
+}
+
+// Next frame to send. Waits for the buffer to fill up first, and for a
+// quarter of it whenever it runs dry, waiting out all of it again would turn
+// every stall into a long gap.
+func (jb *jitterBuffer) next() ([]byte, error) {
+	if !jb.primed {
+		jb.primed = true
+		if !jb.prime(cap(jb.frames)) {
+			return nil, io.EOF
+		}
+	}
+
+	select {
+	case opus, ok := <-jb.frames:
+		return jb.frame(opus, ok)
+	default:
+	}
+
+	atomic.AddInt64(&jitterUnderruns, 1)
+	if !jb.prime(cap(jb.frames)/4 + 1) {
+		return nil, io.EOF
+	}
+	opus, ok := <-jb.frames
+	return jb.frame(opus, ok)
+}
+
+func (jb *jitterBuffer) frame(opus []byte, ok bool) ([]byte, error) {
+	if !ok {
+		return nil, jb.err
+	}
+	return opus, nil
+}
+
+// Waits until the buffer holds depth frames or the pipe is done. Returns
+// false if the play got skipped in the meantime.
+func (jb *jitterBuffer) prime(depth int) bool {
+	if depth > cap(jb.frames) {
+		depth = cap(jb.frames)
+	}
+
+	ticker := time.NewTicker(FRAMEDURATION)
+	defer ticker.Stop()
+
+	for len(jb.frames) < depth {
+		if jb.player.Skipped() {
+			return false
+		}
+		select {
+		case <-jb.done:
+			return true
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// Stops reading from the pipe, which still needs killing
+func (jb *jitterBuffer) close() {
+	close(jb.stop)
+}
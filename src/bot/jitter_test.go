@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dca"
+)
+
+// A stream pipe that only gets frames when the test writes them, standing in
+// for a youtube-dl that stalls whenever it likes. Closing the writer ends it.
+func pacedStreamPipe(t *testing.T) (*streamPipe, *dca.Writer, *io.PipeWriter) {
+	p := newPipeline(context.Background())
+	p.add("true")
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	dw, _ := dca.NewWriter(pw, nil)
+	return &streamPipe{p: p, out: dca.NewRawReader(pr)}, dw, pw
+}
+
+func writeFrames(t *testing.T, dw *dca.Writer, n int) {
+	for i := 0; i < n; i++ {
+		if err := dw.WriteFrame([]byte{0xf8, 0xff, 0xfe}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Shuts everything down and waits for the buffer to stop filling, so nothing
+// is left reading JITTERDEPTH after the test puts it back
+func stopJitter(jb *jitterBuffer, sp *streamPipe, pw *io.PipeWriter) {
+	jb.close()
+	pw.CloseWithError(errPipeClosed)
+	sp.kill()
+	<-jb.done
+}
+
+// Calls next in the background, closing the channel once it comes back
+func nextAsync(jb *jitterBuffer) chan struct{} {
+	result := make(chan struct{})
+	go func() {
+		jb.next()
+		close(result)
+	}()
+	return result
+}
+
+// Whether next came back within a generous amount of time
+func returned(result chan struct{}) bool {
+	select {
+	case <-result:
+		return true
+	case <-time.After(150 * time.Millisecond):
+		return false
+	}
+}
+
+func TestJitterPriming(t *testing.T) {
+	defer func(depth time.Duration) { JITTERDEPTH = depth }(JITTERDEPTH)
+	JITTERDEPTH = 10 * FRAMEDURATION
+
+	tests := []struct {
+		name    string
+		written int
+		end     bool
+		want    bool
+	}{
+		{"nothing yet", 0, false, false},
+		{"part of it", 5, false, false},
+		{"one short", 9, false, false},
+		{"full", 10, false, true},
+		{"short pipe", 3, true, true},
+		{"empty pipe", 0, true, true},
+	}
+	for _, tt := range tests {
+		sp, dw, pw := pacedStreamPipe(t)
+		jb := newJitterBuffer(freshPlayer("jitter-priming"), sp)
+		result := nextAsync(jb)
+
+		writeFrames(t, dw, tt.written)
+		if tt.end {
+			pw.Close()
+		}
+		if got := returned(result); got != tt.want {
+			t.Errorf("%s: returned %v, want %v", tt.name, got, tt.want)
+		}
+
+		stopJitter(jb, sp, pw)
+		<-result
+	}
+}
+
+// Running dry once playing waits for a quarter of the buffer, not all of it
+func TestJitterReprime(t *testing.T) {
+	defer func(depth time.Duration) { JITTERDEPTH = depth }(JITTERDEPTH)
+	JITTERDEPTH = 10 * FRAMEDURATION
+
+	tests := []struct {
+		name    string
+		written int
+		want    bool
+	}{
+		{"dry", 0, false},
+		{"one short", 2, false},
+		{"a quarter and one", 3, true},
+		{"more than enough", 8, true},
+	}
+	for _, tt := range tests {
+		sp, dw, pw := pacedStreamPipe(t)
+		jb := newJitterBuffer(freshPlayer("jitter-reprime"), sp)
+		writeFrames(t, dw, 10)
+		for i := 0; i < 10; i++ {
+			if _, err := jb.next(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Only write once next has found it dry, or it never would
+		underruns := atomic.LoadInt64(&jitterUnderruns)
+		result := nextAsync(jb)
+		for start := time.Now(); atomic.LoadInt64(&jitterUnderruns) == underruns; {
+			if time.Since(start) > time.Second {
+				t.Fatalf("%s: running dry didn't count as an underrun", tt.name)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		writeFrames(t, dw, tt.written)
+		if got := returned(result); got != tt.want {
+			t.Errorf("%s: returned %v, want %v", tt.name, got, tt.want)
+		}
+		if got := atomic.LoadInt64(&jitterUnderruns) - underruns; got != 1 {
+			t.Errorf("%s: counted %d underruns, want 1", tt.name, got)
+		}
+
+		stopJitter(jb, sp, pw)
+		<-result
+	}
+}
+
+// A full buffer nobody takes from for a whole JITTERDEPTH is an overrun,
+// unless the player is paused
+func TestJitterOverrun(t *testing.T) {
+	defer func(depth time.Duration) { JITTERDEPTH = depth }(JITTERDEPTH)
+	JITTERDEPTH = 5 * FRAMEDURATION
+
+	tests := []struct {
+		name    string
+		written int
+		paused  bool
+		want    int64
+	}{
+		{"room left", 5, false, 0},
+		{"held up", 6, false, 1},
+		{"paused", 6, true, 0},
+	}
+	for _, tt := range tests {
+		sp, dw, pw := pacedStreamPipe(t)
+		player := freshPlayer("jitter-overrun")
+		player.paused = tt.paused
+		jb := newJitterBuffer(player, sp)
+
+		overruns := atomic.LoadInt64(&jitterOverruns)
+		writeFrames(t, dw, tt.written)
+		time.Sleep(3 * JITTERDEPTH)
+		if got := atomic.LoadInt64(&jitterOverruns) - overruns; got != tt.want {
+			t.Errorf("%s: counted %d overruns, want %d", tt.name, got, tt.want)
+		}
+
+		stopJitter(jb, sp, pw)
+	}
+}
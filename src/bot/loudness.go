@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"dca"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Loudness everything gets normalized to, in EBU R128 terms
+const loudnormTarget = "I=-16:TP=-1.5:LRA=11"
+
+// Loudness - What ffmpeg's loudnorm filter measured for a file, saved next to
+// the dca as <name>.dca.json
+type Loudness struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+	Target       string `json:"target"`
+}
+
+// Runs the first loudnorm pass over a file and parses what it measured. Any
+// filters given run before loudnorm, the same as they will when encoding.
+func measureLoudness(file string, filters ...string) (*Loudness, error) {
+	filters = append(filters, "loudnorm="+loudnormTarget+":print_format=json")
+
+	// Nothing comes out but progress, which is enough to tell it's not stuck
+	p := newPipeline(context.Background())
+	p.add("ffmpeg", "-hide_banner", "-nostats", "-progress", "pipe:1", "-i", file, "-af", strings.Join(filters, ","), "-f", "null", "-")
+	if err := p.run(); err != nil {
+		return nil, err
+	}
+
+	// The measurements are the last JSON object ffmpeg prints
+	out := p.stderr()
+	start := strings.LastIndex(out, "{")
+	end := strings.LastIndex(out, "}")
+	if start < 0 || end < start {
+		return nil, errors.New("no loudnorm output from ffmpeg")
+	}
+
+	l := &Loudness{}
+	if err := json.Unmarshal([]byte(out[start:end+1]), l); err != nil {
+		return nil, err
+	}
+	l.Target = loudnormTarget
+	return l, nil
+}
+
+// Filter for the second loudnorm pass, using what the first one measured
+func (l *Loudness) filter() string {
+	return "loudnorm=" + loudnormTarget +
+		":measured_I=" + l.InputI +
+		":measured_TP=" + l.InputTP +
+		":measured_LRA=" + l.InputLRA +
+		":measured_thresh=" + l.InputThresh +
+		":offset=" + l.TargetOffset +
+		":linear=true"
+}
+
+func loudnessPath(dcaName string) string {
+	return "audio/" + dcaName + ".json"
+}
+
+func saveLoudness(dcaName string, l *Loudness) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(loudnessPath(dcaName), data, 0644)
+}
+
+// Downloads stream to a temporary file so it can be measured, then encodes it
+// into audio/dcaName with the loudness evened out
+func normalizedDownload(stream, dcaName string, meta *dca.Metadata) string {
+	src := "audio/." + dcaName + ".src"
+	defer os.Remove(src)
+
+	p := newPipeline(context.Background())
+	p.add("youtube-dl", "--newline", "-f", ytdlFormat(stream), "-o", src, stream)
+	if err := p.run(); err != nil {
+		log.Println("download err:", err)
+		return stageError(err)
+	}
+	return normalizedEncode(src, dcaName, meta)
+}
+
+// Measures src and encodes it into audio/dcaName with the loudness evened out
+func normalizedEncode(src, dcaName string, meta *dca.Metadata) string {
+	l, err := measureLoudness(src)
+	if err != nil {
+		log.Println("loudness measure err:", err)
+		return "loudness measure error"
+	}
+
+	p := newPipeline(context.Background())
+	p.add("ffmpeg", "-i", src, "-af", l.filter(), "-f", "s16le", "-ar", "48000", "-ac", "2", "pipe:1")
+	p.encoded()
+	if err = p.saveTo("audio/"+dcaName, meta); err != nil {
+		log.Println("encode err:", err)
+		return stageError(err)
+	}
+
+	if err = saveLoudness(dcaName, l); err != nil {
+		log.Println("loudness save err:", err)
+	}
+	return SUCCESS
+}
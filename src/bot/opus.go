@@ -0,0 +1,170 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/layeh/gopus"
+)
+
+const (
+	// Discord wants 48kHz stereo in 20ms frames
+	opusSampleRate = 48000
+	opusChannels   = 2
+	opusFrameSize  = 960
+
+	// Largest opus frame we'll ever encode
+	opusMaxBytes = opusFrameSize * opusChannels * 2
+)
+
+// Decodes opus frames to PCM so they can be changed and encoded again
+type opusTranscoder struct {
+	decoder *gopus.Decoder
+	encoder *gopus.Encoder
+}
+
+func newOpusTranscoder() (*opusTranscoder, error) {
+	decoder, err := gopus.NewDecoder(opusSampleRate, opusChannels)
+	if err != nil {
+		return nil, err
+	}
+
+	encoder, err := gopus.NewEncoder(opusSampleRate, opusChannels, gopus.Audio)
+	if err != nil {
+		return nil, err
+	}
+	encoder.SetBitrate(BITRATE * 1000)
+
+	return &opusTranscoder{
+		decoder: decoder,
+		encoder: encoder,
+	}, nil
+}
+
+// Scales the PCM in place by volume percent, clipping anything that ends up
+// out of range
+func applyVolume(pcm []int16, volume int) {
+	for i, sample := range pcm {
+		pcm[i] = clip16(int32(sample) * int32(volume) / 100)
+	}
+}
+
+func clip16(sample int32) int16 {
+	if sample > 32767 {
+		return 32767
+	}
+	if sample < -32768 {
+		return -32768
+	}
+	return int16(sample)
+}
+
+// Re-encodes opus at volume percent of its original level
+func (t *opusTranscoder) volume(opus []byte, volume int) ([]byte, error) {
+	pcm, err := t.decoder.Decode(opus, opusFrameSize, false)
+	if err != nil {
+		return nil, err
+	}
+	applyVolume(pcm, volume)
+	return t.encoder.Encode(pcm, opusFrameSize, opusMaxBytes)
+}
+
+// Applies the guild volume to frames that are already encoded, only setting up
+// a transcoder once one is actually needed
+type volumeAdjuster struct {
+	transcoder *opusTranscoder
+	failed     bool
+}
+
+func (va *volumeAdjuster) apply(opus []byte, volume int) []byte {
+	if volume == 100 || va.failed {
+		return opus
+	}
+
+	var err error
+	if va.transcoder == nil {
+		va.transcoder, err = newOpusTranscoder()
+		if err != nil {
+			log.Println("opus transcoder err:", err)
+			va.failed = true
+			return opus
+		}
+	}
+
+	adjusted, err := va.transcoder.volume(opus, volume)
+	if err != nil {
+		log.Println("volume transcode err:", err)
+		return opus
+	}
+	return adjusted
+}
+
+// Mixes soundboard clips on top of whatever is playing, both sides get
+// decoded to PCM, summed and encoded again
+type opusMixer struct {
+	music   *gopus.Decoder
+	clip    *gopus.Decoder
+	encoder *gopus.Encoder
+}
+
+func newOpusMixer() (*opusMixer, error) {
+	music, err := gopus.NewDecoder(opusSampleRate, opusChannels)
+	if err != nil {
+		return nil, err
+	}
+
+	clip, err := gopus.NewDecoder(opusSampleRate, opusChannels)
+	if err != nil {
+		return nil, err
+	}
+
+	encoder, err := gopus.NewEncoder(opusSampleRate, opusChannels, gopus.Audio)
+	if err != nil {
+		return nil, err
+	}
+	encoder.SetBitrate(BITRATE * 1000)
+
+	return &opusMixer{
+		music:   music,
+		clip:    clip,
+		encoder: encoder,
+	}, nil
+}
+
+// Starts both decoders over for the next clip. The music decoder has sat idle
+// since the last one, while the encoder is kept so the music it puts out
+// carries on from where it was.
+func (m *opusMixer) restart() error {
+	music, err := gopus.NewDecoder(opusSampleRate, opusChannels)
+	if err != nil {
+		return err
+	}
+
+	clip, err := gopus.NewDecoder(opusSampleRate, opusChannels)
+	if err != nil {
+		return err
+	}
+
+	m.music, m.clip = music, clip
+	return nil
+}
+
+// Mixes one frame of clip at volume percent over one frame of music
+func (m *opusMixer) mix(music, clip []byte, volume int) ([]byte, error) {
+	musicPCM, err := m.music.Decode(music, opusFrameSize, false)
+	if err != nil {
+		return nil, err
+	}
+
+	clipPCM, err := m.clip.Decode(clip, opusFrameSize, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sum in 32 bits so loud parts clip instead of wrapping around
+	for i := range musicPCM {
+		if i >= len(clipPCM) {
+			break
+		}
+		musicPCM[i] = clip16(int32(musicPCM[i]) + int32(clipPCM[i])*int32(volume)/100)
+	}
+	return m.encoder.Encode(musicPCM, opusFrameSize, opusMaxBytes)
+}
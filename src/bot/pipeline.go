@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"dca"
+)
+
+// How much of the end of each stage's stderr is kept for errors
+const stderrTail = 2048
+
+var (
+	errStartTimeout = errors.New("no output before the start timeout")
+	errIdleTimeout  = errors.New("output stalled past the idle timeout")
+	errPipeClosed   = errors.New("pipeline closed")
+)
+
+// PipelineError - Which stage of a pipeline failed, why, and the last thing it
+// had to say on stderr
+type PipelineError struct {
+	Stage  string
+	Err    error
+	Stderr string
+}
+
+func (e *PipelineError) Error() string {
+	if e.Stderr == "" {
+		return e.Stage + ": " + e.Err.Error()
+	}
+	return e.Stage + ": " + e.Err.Error() + ": " + e.Stderr
+}
+
+// Short description of err for chat, naming the stage if it came from a
+// pipeline
+func stageError(err error) string {
+	if perr, ok := err.(*PipelineError); ok {
+		return perr.Stage + " error"
+	}
+	return "pipeline error"
+}
+
+// Keeps the last stderrTail bytes written to it
+type tailBuffer struct {
+	sync.Mutex
+	buf []byte
+}
+
+func (t *tailBuffer) Write(b []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.buf = append(t.buf, b...)
+	if len(t.buf) > stderrTail {
+		t.buf = t.buf[len(t.buf)-stderrTail:]
+	}
+	return len(b), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.Lock()
+	defer t.Unlock()
+	return strings.TrimSpace(string(t.buf))
+}
+
+// One process in a pipeline
+type stage struct {
+	name   string
+	args   []string
+	cmd    *exec.Cmd
+	stderr tailBuffer
+
+	// Set by the goroutine reaping cmd, safe to read once done is closed
+	err  error
+	done chan struct{}
+}
+
+// pipeline - Processes chained stdout to stdin, optionally finished off by
+// the encoder. Every process started gets reaped no matter how it ends.
+type pipeline struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	stages []*stage
+
+	// Run the last stage's output through the encoder
+	encode     bool
+	encodeErr  error
+	encodeDone chan struct{}
+
+	// Read end of the last stage, and what the reader actually gets
+	last *os.File
+	out  io.Reader
+
+	mu      sync.Mutex
+	timeout error
+	closed  bool
+}
+
+func newPipeline(ctx context.Context) *pipeline {
+	ctx, cancel := context.WithCancel(ctx)
+	return &pipeline{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Adds a process reading the previous stage's output
+func (p *pipeline) add(name string, args ...string) {
+	p.stages = append(p.stages, &stage{
+		name: name,
+		args: args,
+		done: make(chan struct{}),
+	})
+}
+
+// Has the encoder turn the PCM coming out of the last stage into dca
+func (p *pipeline) encoded() {
+	p.encode = true
+	p.encodeDone = make(chan struct{})
+}
+
+// Starts every stage. If any of them fail to start the ones already running
+// are killed and reaped.
+func (p *pipeline) start() error {
+	var (
+		prev       *os.File
+		parentEnds []*os.File
+	)
+	closeEnds := func() {
+		for _, f := range parentEnds {
+			f.Close()
+		}
+	}
+
+	for i, st := range p.stages {
+		st.cmd = exec.CommandContext(p.ctx, st.name, st.args...)
+		if prev != nil {
+			st.cmd.Stdin = prev
+			parentEnds = append(parentEnds, prev)
+		}
+		st.cmd.Stderr = &st.stderr
+
+		r, w, err := os.Pipe()
+		if err != nil {
+			closeEnds()
+			p.abort(i)
+			return &PipelineError{Stage: st.name, Err: err}
+		}
+		st.cmd.Stdout = w
+		parentEnds = append(parentEnds, w)
+		prev = r
+
+		if err = st.cmd.Start(); err != nil {
+			closeEnds()
+			prev.Close()
+			p.abort(i)
+			return &PipelineError{Stage: st.name, Err: err}
+		}
+		go st.reap()
+	}
+
+	// The children have their own copies now, ours would keep the pipes open
+	// after they exit
+	closeEnds()
+
+	p.last = prev
+	var src io.Reader = &watchdog{p: p, r: prev}
+	if !p.encode {
+		p.out = src
+		return nil
+	}
+
+	encoded, out := io.Pipe()
+	p.out = encoded
+	go func() {
+		err := encoder.Encode(p.ctx, bufio.NewReaderSize(src, 16384), out)
+		// Done before the pipe closes, so whoever reads the error can tell
+		// it came from the encoder
+		p.encodeErr = err
+		close(p.encodeDone)
+		// A nil error closes the pipe with io.EOF
+		out.CloseWithError(err)
+	}()
+	return nil
+}
+
+// Kills the first n stages, which are already running
+func (p *pipeline) abort(n int) {
+	p.cancel()
+	for _, st := range p.stages[:n] {
+		<-st.done
+	}
+}
+
+func (st *stage) reap() {
+	st.err = st.cmd.Wait()
+	close(st.done)
+}
+
+// Reads the pipeline's output
+func (p *pipeline) Read(b []byte) (int, error) {
+	return p.out.Read(b)
+}
+
+// Waits for everything to exit and returns the first real failure. Only call
+// once the output has been read to the end.
+func (p *pipeline) wait() error {
+	for _, st := range p.stages {
+		<-st.done
+	}
+	if p.encode {
+		<-p.encodeDone
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+
+	// Everything got killed for taking too long, blame what we were waiting on
+	if p.timeout != nil {
+		st := p.stages[len(p.stages)-1]
+		return &PipelineError{Stage: st.name, Err: p.timeout, Stderr: st.stderr.String()}
+	}
+
+	// Upstream first, since whatever comes after a failed stage usually
+	// fails too. Stages that only died because the next one went away first
+	// don't count.
+	for _, st := range p.stages {
+		if st.err != nil && !brokenPipe(st.err) {
+			return &PipelineError{Stage: st.name, Err: st.err, Stderr: st.stderr.String()}
+		}
+	}
+	if p.encodeErr != nil {
+		return &PipelineError{Stage: "encoder", Err: p.encodeErr}
+	}
+	return nil
+}
+
+// Kills whatever is still running. The stages get reaped in the background.
+func (p *pipeline) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	p.cancel()
+	if p.last != nil {
+		p.last.Close()
+	}
+	if encoded, ok := p.out.(*io.PipeReader); ok {
+		encoded.CloseWithError(errPipeClosed)
+	}
+}
+
+// Kills the pipeline because it took too long, keeping why for wait. The
+// output gets closed as well, in case something the stages forked is still
+// holding it open.
+func (p *pipeline) expire(err error) {
+	p.mu.Lock()
+	if p.timeout == nil {
+		p.timeout = err
+	}
+	p.mu.Unlock()
+
+	p.cancel()
+	p.last.Close()
+}
+
+func (p *pipeline) expired() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.timeout != nil
+}
+
+// Runs the pipeline to the end, saving its output to path as a DCA1 file
+// described by meta
+func (p *pipeline) saveTo(path string, meta *dca.Metadata) error {
+	if err := p.start(); err != nil {
+		return err
+	}
+	defer p.close()
+
+	err := saveDCA(p, path, meta, p.wait)
+	if _, ok := err.(*dca.FrameError); ok && p.encode {
+		// The encoder failing cuts its output short, it knows better why
+		select {
+		case <-p.encodeDone:
+			if p.encodeErr != nil {
+				return &PipelineError{Stage: "encoder", Err: p.encodeErr}
+			}
+		default:
+		}
+	}
+	return err
+}
+
+// Runs the pipeline to the end and returns everything it wrote, for one-shot
+// lookups that print their answer once they're done
+func (p *pipeline) output() ([]byte, error) {
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+	defer p.close()
+
+	out, err := ioutil.ReadAll(p)
+	if werr := p.wait(); werr != nil {
+		return out, werr
+	}
+	return out, err
+}
+
+// Runs the pipeline to the end, throwing away what it wrote. For stages that
+// write a file and only print progress, which still keeps the timeouts at bay.
+func (p *pipeline) run() error {
+	if err := p.start(); err != nil {
+		return err
+	}
+	defer p.close()
+
+	_, err := io.Copy(ioutil.Discard, p)
+	if werr := p.wait(); werr != nil {
+		return werr
+	}
+	return err
+}
+
+// What the last stage said on stderr, up to stderrTail of it
+func (p *pipeline) stderr() string {
+	return p.stages[len(p.stages)-1].stderr.String()
+}
+
+// Runs name to the end and returns what it printed, killing it if it's
+// silent past the start timeout
+func commandOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	p := newPipeline(ctx)
+	p.add(name, args...)
+	return p.output()
+}
+
+// True if err is a process getting killed for writing to a closed pipe
+func brokenPipe(err error) bool {
+	exit, ok := err.(*exec.ExitError)
+	if !ok {
+		return false
+	}
+	status, ok := exit.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGPIPE
+}
+
+// Kills the pipeline when the last stage takes too long to produce anything.
+// Only time spent waiting inside Read counts, so a reader that's slow or
+// stops reading for a while doesn't trip it.
+type watchdog struct {
+	p       *pipeline
+	r       io.Reader
+	started bool
+}
+
+func (w *watchdog) Read(b []byte) (int, error) {
+	limit, reason := PIPEIDLETIMEOUT, errIdleTimeout
+	if !w.started {
+		limit, reason = PIPESTARTTIMEOUT, errStartTimeout
+	}
+	if limit > 0 {
+		timer := time.AfterFunc(limit, func() {
+			w.p.expire(reason)
+		})
+		defer timer.Stop()
+	}
+
+	n, err := w.r.Read(b)
+	if n > 0 {
+		w.started = true
+	}
+	// Reading a closed file fails, but it's just the end as far as the
+	// reader is concerned and wait says why
+	if err != nil && w.p.expired() {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"dca"
+)
+
+// Stands in for the real encoder, writing frames frames whatever the PCM and
+// then failing with err
+type stubEncoder struct {
+	frames int
+	err    error
+}
+
+func (e stubEncoder) Encode(ctx context.Context, pcm io.Reader, out io.Writer) error {
+	io.Copy(ioutil.Discard, pcm)
+	dw, _ := dca.NewWriter(out, nil)
+	for i := 0; i < e.frames; i++ {
+		if err := dw.WriteFrame([]byte{0xf8, 0xff, 0xfe}); err != nil {
+			return err
+		}
+	}
+	return e.err
+}
+
+// Runs a pipeline of cat through e into a file in a temporary directory,
+// returning the file's path and what saveTo returned
+func saveWith(t *testing.T, e Encoder) (string, error) {
+	old := encoder
+	encoder = e
+	defer func() { encoder = old }()
+
+	dir, err := ioutil.TempDir("", "pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "out.dca")
+
+	p := newPipeline(context.Background())
+	p.add("cat")
+	p.encoded()
+	return path, p.saveTo(path, newDCAMetadata("test", "file", "", ""))
+}
+
+func TestSaveEncoded(t *testing.T) {
+	path, err := saveWith(t, stubEncoder{frames: 5})
+	defer os.RemoveAll(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	dr, err := dca.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dr.Metadata == nil || dr.Metadata.Duration() != 5*FRAMEDURATION {
+		t.Errorf("header doesn't say 5 frames long: %+v", dr.Metadata)
+	}
+	for {
+		if _, err = dr.ReadFrame(); err != nil {
+			break
+		}
+	}
+	if dr.Frames() != 5 || err != io.EOF {
+		t.Errorf("got %d frames, %v, want 5 and the end", dr.Frames(), err)
+	}
+}
+
+func TestSaveEncoderError(t *testing.T) {
+	stubErr := errors.New("stub encoder failed")
+	path, err := saveWith(t, stubEncoder{frames: 2, err: stubErr})
+	defer os.RemoveAll(filepath.Dir(path))
+
+	perr, ok := err.(*PipelineError)
+	if !ok || perr.Stage != "encoder" || perr.Err != stubErr {
+		t.Errorf("got %v, want the encoder's error", err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("a failed encode left %s behind", path)
+	}
+}
@@ -0,0 +1,1081 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+)
+
+// What people who aren't DJs get for touching plays that aren't theirs
+var errNotYours = errors.New("only DJs can touch other people's plays, use `skip` to vote")
+
+var (
+	// Map of Guild id's to their player, guarded by playersMu
+	players   = make(map[string]*GuildPlayer)
+	playersMu sync.Mutex
+)
+
+// RepeatMode - What the player does once a play finishes
+type RepeatMode int
+
+// Repeat modes, RepeatAutoplay keeps going with cached tracks once the queue
+// is empty
+const (
+	RepeatOff RepeatMode = iota
+	RepeatTrack
+	RepeatQueue
+	RepeatAutoplay
+)
+
+var repeatModeNames = []string{"off", "track", "queue", "autoplay"}
+
+func (r RepeatMode) String() string {
+	if r < 0 || int(r) >= len(repeatModeNames) {
+		return repeatModeNames[RepeatOff]
+	}
+	return repeatModeNames[r]
+}
+
+func parseRepeatMode(name string) (RepeatMode, bool) {
+	for i, n := range repeatModeNames {
+		if n == name {
+			return RepeatMode(i), true
+		}
+	}
+	return RepeatOff, false
+}
+
+// GuildSettings - Per guild toggles, persisted in sconfigs/
+type GuildSettings struct {
+	// gifPosting toggle for gifPost
+	GifPosting  bool
+	Caching     bool
+	MemeTimeout time.Duration
+	MemeVoice   bool
+	Repeat      RepeatMode
+
+	// Mix soundboard clips over the current play instead of cutting in
+	MemeMix bool
+
+	// Percentage of listeners that have to vote before a skip goes through,
+	// 0 lets anyone skip on their own
+	SkipRatio int
+
+	// Volume in percent, 0 - 200
+	Volume int
+
+	// Run cached files and tags through two loudnorm passes, and streams
+	// through one
+	Normalize bool
+
+	// Keep the last RECORDLENGTH of voice around so clip can save it
+	Recording bool
+}
+
+// GuildPlayer owns everything one guild needs to play sounds: the queue, the
+// voice connection, the skip flag and the guild settings. All of it sits
+// behind the embedded mutex, so command handlers and the playSound loop can
+// touch it from different goroutines.
+type GuildPlayer struct {
+	sync.Mutex
+
+	GuildID string
+
+	// Plays waiting behind the current one in order, used for queuing and
+	// rate-limiting
+	queue []*Play
+
+	// True while a playSound loop owns this guild
+	playing bool
+	vc      *discordgo.VoiceConnection
+	skipped bool
+
+	// What's playing right now
+	current *Play
+
+	// Frames sent so far in the current play, and the frame the frame loop
+	// should jump to (-1 if nobody's seeking)
+	position int
+	seekTo   int
+
+	// Soundboard clips waiting to cut in on the current play, send pokes
+	// kick when one arrives while paused
+	priority []*Play
+	kick     chan struct{}
+
+	// Clip being mixed over the current play in MemeMix mode and how far
+	// into it we are. mixer belongs to the current play and is only touched
+	// by the goroutine playing it.
+	mixPlay   *Play
+	mixFrames *soundFrames
+	mixer     *opusMixer
+
+	// The next play, if it's a stream being buffered ahead of time, and
+	// whether one is being started right now
+	prefetch    *prefetch
+	prefetching bool
+
+	// While paused the frame loops block in send until wake is closed
+	paused bool
+	wake   chan struct{}
+
+	// Set once a pause times out and we leave the channel, the queue stays
+	// as it was until Resume or a new play picks it back up. resumePlay
+	// starts from frame resumeAt when it next plays.
+	parked     bool
+	resumePlay *Play
+	resumeAt   int
+
+	// Users who voted to skip the current play
+	votes map[string]bool
+
+	// Set by Stop so repeat modes don't keep things going
+	stopped bool
+
+	// Bumped whenever the queue is cleared, so playlists still being queued
+	// know to give up
+	generation int
+
+	// What's been said in the voice channel, fed while connected by a
+	// listener that stops when listenStop is closed
+	recorder   *voiceRecorder
+	listenStop chan struct{}
+
+	// Last text channel anything was queued from, notices for plays that
+	// don't have one of their own go there
+	textChannelID string
+
+	settings GuildSettings
+	lastMeme time.Time
+}
+
+// Settings for guilds we haven't saved anything for yet
+func defaultSettings() GuildSettings {
+	return GuildSettings{
+		MemeVoice: true,
+		SkipRatio: 50,
+		Volume:    100,
+	}
+}
+
+// Get the player for a guild, creating it the first time it's asked for
+func getPlayer(guildID string) *GuildPlayer {
+	playersMu.Lock()
+	defer playersMu.Unlock()
+
+	p, exists := players[guildID]
+	if !exists {
+		p = &GuildPlayer{
+			GuildID:  guildID,
+			seekTo:   -1,
+			kick:     make(chan struct{}, 1),
+			recorder: newVoiceRecorder(),
+			settings: defaultSettings(),
+		}
+		players[guildID] = p
+	}
+	return p
+}
+
+// Adds a play to the queue. Returns true if nothing is playing yet, in which
+// case the caller has to start the playSound loop with this play itself.
+func (p *GuildPlayer) enqueue(play *Play) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	play.Queued = time.Now()
+	if play.TextChannelID != "" {
+		p.textChannelID = play.TextChannelID
+	}
+
+	// Whatever was parked goes first, this one waits its turn
+	if p.parked {
+		p.queue = append(p.queue, play)
+		p.unpark()
+		return false
+	}
+
+	if !p.playing {
+		p.playing = true
+		return true
+	}
+
+	if len(p.queue) < MAXQSIZE {
+		p.queue = append(p.queue, play)
+	} else {
+		discardAttachments([]*Play{play})
+	}
+	return false
+}
+
+// Pops the play that should follow finished off the queue, or nil if it's
+// empty. Looping puts finished back where it belongs first, unless it failed
+// to play.
+func (p *GuildPlayer) next(finished *Play) *Play {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.parked {
+		return nil
+	}
+	// Parking put it back in the queue already
+	if finished == p.resumePlay {
+		return p.pop()
+	}
+
+	if !p.stopped && !finished.chainFailed() {
+		switch p.settings.Repeat {
+		case RepeatTrack:
+			// Skipping a looped track moves on to the next one
+			if !p.skipped {
+				return finished
+			}
+		case RepeatQueue:
+			p.queue = append(p.queue, finished)
+			return p.pop()
+		}
+	}
+	discardAttachments([]*Play{finished})
+	return p.pop()
+}
+
+// True if the queue ran dry and autoplay should pick something
+func (p *GuildPlayer) wantsAutoplay() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.settings.Repeat == RepeatAutoplay && !p.stopped && !p.parked
+}
+
+// Caller must hold the lock
+func (p *GuildPlayer) pop() *Play {
+	// Clips that came in too late to cut in on the last play go first
+	if len(p.priority) > 0 {
+		p.queue = append(p.priority, p.queue...)
+		p.priority = nil
+	}
+	if len(p.queue) == 0 {
+		return nil
+	}
+	play := p.queue[0]
+	p.queue[0] = nil
+	p.queue = p.queue[1:]
+	return play
+}
+
+// Called by playSound once the queue looks empty. If something snuck in
+// while we were waiting to part it's returned, otherwise the voice
+// connection is closed and the player goes idle.
+func (p *GuildPlayer) finish(vc *discordgo.VoiceConnection) *Play {
+	p.Lock()
+	defer p.Unlock()
+
+	// A parked queue waits for Resume with us out of the channel
+	if !p.parked {
+		if play := p.pop(); play != nil {
+			return play
+		}
+	}
+
+	// Disconnect while holding the lock so a new enqueue can't grab the
+	// connection we're tearing down
+	if vc != nil {
+		vc.Disconnect()
+	}
+	p.stopListening()
+	p.vc = nil
+	p.current = nil
+	p.playing = false
+	p.stopped = false
+	p.unpause()
+	p.dropPrefetch()
+	return nil
+}
+
+// Drops everything queued and marks the player idle, used when we couldn't
+// get into a voice channel at all
+func (p *GuildPlayer) reset() {
+	p.Lock()
+	defer p.Unlock()
+
+	discardAttachments(p.queue)
+	p.queue = nil
+	p.parked = false
+	p.resumePlay = nil
+	p.stopListening()
+	p.vc = nil
+	p.current = nil
+	p.playing = false
+	p.unpause()
+	p.dropPrefetch()
+}
+
+// Marks play as the one being played over vc
+func (p *GuildPlayer) nowPlaying(play *Play, vc *discordgo.VoiceConnection) {
+	p.Lock()
+	if vc != p.vc {
+		p.stopListening()
+		if recv := opusRecv(vc); recv != nil {
+			p.listenStop = make(chan struct{})
+			go p.recorder.listen(recv, p.listenStop, p.recording)
+		}
+	}
+	p.vc = vc
+	p.skipped = false
+	p.current = play
+	p.stopped = false
+	p.votes = make(map[string]bool)
+	p.position = 0
+	p.seekTo = -1
+	// Each play gets a mixer of its own once a clip comes along
+	p.mixer = nil
+	// Anything prefetched is for this play or the one after it, otherwise
+	// the play it was for got dropped on the way
+	if p.prefetch != nil && p.prefetch.play != play && (len(p.queue) == 0 || p.queue[0] != p.prefetch.play) {
+		p.dropPrefetch()
+	}
+	if play == p.resumePlay {
+		p.seekTo = p.resumeAt
+		p.resumePlay = nil
+	}
+	p.Unlock()
+}
+
+// SetTextChannel - Remembers where the guild last asked for something
+func (p *GuildPlayer) SetTextChannel(channelID string) {
+	p.Lock()
+	p.textChannelID = channelID
+	p.Unlock()
+}
+
+// TextChannel - Where notices for the guild go when a play has no text
+// channel of its own
+func (p *GuildPlayer) TextChannel() string {
+	p.Lock()
+	defer p.Unlock()
+	if p.textChannelID == "" {
+		// The default channel shares the guild's ID
+		return p.GuildID
+	}
+	return p.textChannelID
+}
+
+// Playing - True if a playSound loop is running for this guild
+func (p *GuildPlayer) Playing() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.playing
+}
+
+// Current - The play being played, nil if nothing is
+func (p *GuildPlayer) Current() *Play {
+	p.Lock()
+	defer p.Unlock()
+	return p.current
+}
+
+// QueueLength - Number of plays waiting behind the current one
+func (p *GuildPlayer) QueueLength() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.queue)
+}
+
+// Queue - Snapshot of the current play, how far into it we are, and
+// everything waiting behind it
+func (p *GuildPlayer) Queue() (current *Play, elapsed time.Duration, queue []*Play) {
+	p.Lock()
+	defer p.Unlock()
+
+	queue = make([]*Play, len(p.queue))
+	copy(queue, p.queue)
+	return p.current, time.Duration(p.position) * FRAMEDURATION, queue
+}
+
+// Generation - Changes every time the queue is cleared
+func (p *GuildPlayer) Generation() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.generation
+}
+
+// Remove - Drops queue entries from through to (1 based, inclusive), returns
+// how many were removed. With userID set, every entry has to be one that user
+// queued.
+func (p *GuildPlayer) Remove(from, to int, userID string) (int, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if from < 1 {
+		from = 1
+	}
+	if to > len(p.queue) {
+		to = len(p.queue)
+	}
+	if from > to {
+		return 0, nil
+	}
+	if !p.queuedBy(from, to, userID) {
+		return 0, errNotYours
+	}
+	discardAttachments(p.queue[from-1 : to])
+	p.queue = append(p.queue[:from-1], p.queue[to:]...)
+	p.dropStalePrefetch()
+	return to - from + 1, nil
+}
+
+// Move - Moves the entry at position from to position to (1 based)
+func (p *GuildPlayer) Move(from, to int) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if from < 1 || from > len(p.queue) || to < 1 || to > len(p.queue) {
+		return false
+	}
+	play := p.queue[from-1]
+	p.queue = append(p.queue[:from-1], p.queue[from:]...)
+	p.queue = append(p.queue[:to-1], append([]*Play{play}, p.queue[to-1:]...)...)
+	p.dropStalePrefetch()
+	return true
+}
+
+// Shuffle the queue, the current play is left alone
+func (p *GuildPlayer) Shuffle() {
+	p.Lock()
+	defer p.Unlock()
+
+	for i := len(p.queue) - 1; i > 0; i-- {
+		j := rand.Intn(i + 1)
+		p.queue[i], p.queue[j] = p.queue[j], p.queue[i]
+	}
+	p.dropStalePrefetch()
+}
+
+// Clear - Drops everything waiting in the queue, returns how many were dropped
+func (p *GuildPlayer) Clear() int {
+	p.Lock()
+	defer p.Unlock()
+
+	n := len(p.queue)
+	discardAttachments(p.queue)
+	p.queue = nil
+	p.generation++
+	p.dropPrefetch()
+	return n
+}
+
+// SkipTo - Drops everything before position n and skips the current play, so
+// n plays next. With userID set, the current play and everything skipped
+// over have to be ones that user queued.
+func (p *GuildPlayer) SkipTo(n int, userID string) (bool, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if n < 1 || n > len(p.queue) {
+		return false, nil
+	}
+	if userID != "" && (p.current == nil || p.current.UserID != userID || !p.queuedBy(1, n-1, userID)) {
+		return false, errNotYours
+	}
+	discardAttachments(p.queue[:n-1])
+	p.queue = p.queue[n-1:]
+	p.skipped = true
+	p.unpause()
+	p.dropStalePrefetch()
+	return true, nil
+}
+
+// True if userID queued every entry from through to (1 based, inclusive), or
+// if userID is empty. Caller must hold the lock.
+func (p *GuildPlayer) queuedBy(from, to int, userID string) bool {
+	if userID == "" {
+		return true
+	}
+	for _, play := range p.queue[from-1 : to] {
+		if play.UserID != userID {
+			return false
+		}
+	}
+	return true
+}
+
+// Stop - Clears the queue and skips the current play, playSound then leaves
+// the channel on its own
+func (p *GuildPlayer) Stop() {
+	p.Lock()
+	defer p.Unlock()
+
+	discardAttachments(p.queue)
+	p.queue = nil
+	p.priority = nil
+	p.parked = false
+	p.resumePlay = nil
+	p.mixPlay = nil
+	p.closeMixFrames()
+	p.generation++
+	p.skipped = true
+	p.stopped = true
+	p.unpause()
+	p.dropPrefetch()
+}
+
+// Skip the sound that's currently playing
+func (p *GuildPlayer) Skip() {
+	p.Lock()
+	p.skipped = true
+	p.unpause()
+	p.Unlock()
+}
+
+// VoiceChannel - Channel the player is currently playing in, empty if none
+func (p *GuildPlayer) VoiceChannel() string {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.vc == nil {
+		return ""
+	}
+	return p.vc.ChannelID
+}
+
+// Vote - Records userID's vote to skip the current play. Only votes from
+// listeners count, once enough of them are in the play is skipped.
+func (p *GuildPlayer) Vote(userID string, listeners []string) (votes, needed int, skipped bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.current == nil {
+		return 0, 0, false
+	}
+	p.votes[userID] = true
+
+	for _, listener := range listeners {
+		if p.votes[listener] {
+			votes++
+		}
+	}
+
+	needed = (len(listeners)*p.settings.SkipRatio + 99) / 100
+	if needed < 1 {
+		needed = 1
+	}
+
+	if votes >= needed {
+		p.skipped = true
+		p.unpause()
+		return votes, needed, true
+	}
+	return votes, needed, false
+}
+
+// Pause - Holds the current play, returns false if there's nothing to pause
+func (p *GuildPlayer) Pause() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.playing || p.paused {
+		return false
+	}
+	p.paused = true
+	p.wake = make(chan struct{})
+	return true
+}
+
+// Resume - Lets a paused play carry on, rejoining the channel if the pause
+// timed out. Returns false if it wasn't paused.
+func (p *GuildPlayer) Resume() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.parked {
+		p.unpark()
+		return true
+	}
+	return p.unpause()
+}
+
+// Leaves the channel once a pause times out, putting the current play back at
+// the front of the queue so it picks up where it stopped
+func (p *GuildPlayer) park() {
+	p.Lock()
+	defer p.Unlock()
+
+	// Resumed just as it timed out
+	if !p.paused {
+		return
+	}
+	p.unpause()
+	if p.current != nil {
+		p.queue = append([]*Play{p.current}, p.queue...)
+		p.resumePlay, p.resumeAt = p.current, p.position
+	}
+	p.parked = true
+	p.skipped = true
+	p.dropPrefetch()
+}
+
+// Picks a parked queue back up. If the playSound loop hasn't left yet it
+// just carries on, otherwise a new one is started. Caller must hold the lock.
+func (p *GuildPlayer) unpark() {
+	p.parked = false
+	if p.playing {
+		return
+	}
+	play := p.pop()
+	if play == nil {
+		return
+	}
+	p.playing = true
+	go playSound(play, nil)
+}
+
+
+// Caller must hold the lock
+func (p *GuildPlayer) unpause() bool {
+	if !p.paused {
+		return false
+	}
+	p.paused = false
+	close(p.wake)
+	return true
+}
+
+// Paused - True while the current play is held
+func (p *GuildPlayer) Paused() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.paused
+}
+
+// Sends one opus frame over vc, blocking for as long as the player is paused.
+// Streams are held by backpressure since their frame loop stops reading. Returns
+// false when the frame loop should stop.
+func (p *GuildPlayer) send(vc *discordgo.VoiceConnection, opus []byte) bool {
+	var mixing bool
+	for {
+		p.Lock()
+		paused, wake := p.paused, p.wake
+		skipped := p.skipped
+		mixing = p.settings.MemeMix
+		p.Unlock()
+
+		if skipped {
+			return false
+		}
+
+		// Soundboard clips go first and the current play just waits here,
+		// unless they get mixed over it. Nothing to mix with while paused.
+		if (!mixing || paused) && p.playPriority(vc) {
+			continue
+		}
+		if !paused {
+			break
+		}
+
+		// Nobody wants to see a green ring around someone who isn't talking
+		vc.Speaking(false)
+
+		var (
+			timer   *time.Timer
+			timeout <-chan time.Time
+		)
+		if PAUSETIMEOUT > 0 {
+			timer = time.NewTimer(PAUSETIMEOUT)
+			timeout = timer.C
+		}
+
+		select {
+		case <-wake:
+		case <-p.kick:
+		case <-timeout:
+			if PAUSERESUME {
+				p.Resume()
+			} else {
+				p.park()
+			}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		vc.Speaking(true)
+	}
+
+	if mixing {
+		opus = p.mix(opus)
+	}
+	vc.OpusSend <- opus
+
+	p.Lock()
+	p.position++
+	if p.prefetchDue() {
+		p.prefetching = true
+		go p.startPrefetch(p.queue[0], p.settings)
+	}
+	p.Unlock()
+	return true
+}
+
+// True once the current play is close enough to its end that the next one
+// should start buffering. Caller must hold the lock.
+func (p *GuildPlayer) prefetchDue() bool {
+	if p.prefetch != nil || p.prefetching || PREFETCHBYTES <= 0 || len(p.queue) == 0 || p.current == nil {
+		return false
+	}
+	// Looping a track means the queue isn't what comes next
+	if p.settings.Repeat == RepeatTrack {
+		return false
+	}
+	if streamLink(p.queue[0]) == "" {
+		return false
+	}
+	// Without a duration there's no telling when the end is, so start now
+	if p.current.Duration == 0 {
+		return true
+	}
+	return p.current.Duration-time.Duration(p.position)*FRAMEDURATION <= PREFETCHAHEAD
+}
+
+// Starts buffering play, which is next in the queue. Starting the pipeline
+// happens without the lock, so the queue may have moved on by the time it's
+// running.
+func (p *GuildPlayer) startPrefetch(play *Play, settings GuildSettings) {
+	pf, err := startPrefetch(play, settings)
+
+	p.Lock()
+	defer p.Unlock()
+	p.prefetching = false
+	if err != nil {
+		log.Println("prefetch start err:", err)
+		return
+	}
+	if p.prefetch != nil || len(p.queue) == 0 || p.queue[0] != play {
+		pf.cancel()
+		return
+	}
+	p.prefetch = pf
+}
+
+// Throws away the prefetch. Caller must hold the lock.
+func (p *GuildPlayer) dropPrefetch() {
+	if p.prefetch != nil {
+		p.prefetch.cancel()
+		p.prefetch = nil
+	}
+}
+
+// Throws away the prefetch if the queue changed under it. Caller must hold
+// the lock.
+func (p *GuildPlayer) dropStalePrefetch() {
+	if p.prefetch != nil && (len(p.queue) == 0 || p.queue[0] != p.prefetch.play) {
+		p.dropPrefetch()
+	}
+}
+
+// Hands over the prefetched pipe if it was for the current play and s, nil
+// if there isn't one. A prefetch for the play after is left alone, the
+// current one is only restarting.
+func (p *GuildPlayer) takePrefetch(s *Sound) *streamPipe {
+	p.Lock()
+	pf := p.prefetch
+	if pf == nil || pf.play != p.current || pf.play.Sound != s {
+		p.Unlock()
+		return nil
+	}
+	p.prefetch = nil
+	p.Unlock()
+
+	return pf.take()
+}
+
+// Puts a soundboard clip on the priority lane if something is already playing
+// in the channel it's meant for. Returns false if it should be queued normally.
+func (p *GuildPlayer) interrupt(play *Play) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.playing || p.current == nil || p.vc == nil || p.vc.ChannelID != play.ChannelID {
+		return false
+	}
+	if len(p.priority) >= MAXQSIZE {
+		return true
+	}
+	p.priority = append(p.priority, play)
+
+	select {
+	case p.kick <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Plays every clip waiting on the priority lane, chains included. Returns
+// true if there was anything to play.
+func (p *GuildPlayer) playPriority(vc *discordgo.VoiceConnection) (played bool) {
+	for {
+		p.Lock()
+		if len(p.priority) == 0 {
+			p.Unlock()
+			return played
+		}
+		played = true
+		play := p.priority[0]
+		p.priority = p.priority[1:]
+		p.Unlock()
+
+		var volume volumeAdjuster
+	chain:
+		for ; play != nil; play = play.Next {
+			go trackSoundStats(play)
+			sf, err := openSound(play.Sound.file())
+			if err != nil {
+				log.Println("error opening dca file :", err)
+				continue
+			}
+			for {
+				opus, err := sf.next()
+				if err != nil {
+					break
+				}
+				if p.skipClip() {
+					sf.close()
+					break chain
+				}
+				vc.OpusSend <- volume.apply(opus, p.Settings().Volume)
+			}
+			sf.close()
+		}
+	}
+}
+
+// Mixes the next frame of the clip on the priority lane over opus, if there
+// is one. Each play keeps one mixer, its decoders start over with every clip
+// since they only see frames while one is going.
+func (p *GuildPlayer) mix(opus []byte) []byte {
+	clip, first := p.nextClipFrame()
+	if clip == nil {
+		return opus
+	}
+
+	if p.mixer == nil {
+		mixer, err := newOpusMixer()
+		if err != nil {
+			log.Println("opus mixer err:", err)
+			return opus
+		}
+		p.mixer = mixer
+	} else if first {
+		if err := p.mixer.restart(); err != nil {
+			log.Println("opus mixer err:", err)
+			return opus
+		}
+	}
+
+	mixed, err := p.mixer.mix(opus, clip, p.Settings().Volume)
+	if err != nil {
+		log.Println("mix err:", err)
+		return opus
+	}
+	return mixed
+}
+
+// Next frame of whatever clip is being mixed in, moving on through chains and
+// the priority lane, and whether it's the first of its clip. Nil once there's
+// nothing left.
+func (p *GuildPlayer) nextClipFrame() ([]byte, bool) {
+	first := false
+	for {
+		p.Lock()
+		if p.mixPlay == nil {
+			if len(p.priority) == 0 {
+				p.Unlock()
+				return nil, false
+			}
+			p.mixPlay = p.priority[0]
+			p.priority = p.priority[1:]
+			go trackSoundStats(p.mixPlay)
+		}
+		play, sf := p.mixPlay, p.mixFrames
+		p.Unlock()
+
+		// Opening can mean reading the whole file into the cache, which
+		// mustn't hold up every command on the guild
+		opened := false
+		if sf == nil {
+			var err error
+			if sf, err = openSound(play.Sound.file()); err != nil {
+				log.Println("error opening dca file :", err)
+			} else {
+				opened, first = true, true
+			}
+		}
+
+		p.Lock()
+		if p.mixPlay != play {
+			// Stopped while it was being opened
+			if opened {
+				sf.close()
+			}
+			p.Unlock()
+			continue
+		}
+		p.mixFrames = sf
+		if sf != nil {
+			if opus, err := sf.next(); err == nil {
+				p.Unlock()
+				return opus, first
+			}
+			p.closeMixFrames()
+		}
+
+		p.mixPlay = play.Next
+		if p.mixPlay != nil {
+			go trackSoundStats(p.mixPlay)
+		}
+		p.Unlock()
+	}
+}
+
+// Caller must hold the lock
+func (p *GuildPlayer) closeMixFrames() {
+	if p.mixFrames != nil {
+		p.mixFrames.close()
+		p.mixFrames = nil
+	}
+}
+
+// True if a clip on the priority lane should stop. A skip only takes out the
+// clip and leaves the play underneath alone, a stop takes out everything.
+func (p *GuildPlayer) skipClip() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.skipped && !p.stopped {
+		p.skipped = false
+		return true
+	}
+	return p.skipped
+}
+
+// Seek - Asks the current play to jump to offset, or by offset if relative.
+// Returns false if nothing is playing.
+func (p *GuildPlayer) Seek(offset time.Duration, relative bool) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.current == nil {
+		return false
+	}
+
+	frame := int(offset / FRAMEDURATION)
+	if relative {
+		frame += p.position
+	}
+	if frame < 0 {
+		frame = 0
+	}
+	p.seekTo = frame
+	return true
+}
+
+// Picks up a pending seek for the frame loop, moving the position there
+func (p *GuildPlayer) takeSeek() (int, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.seekTo < 0 {
+		return 0, false
+	}
+	frame := p.seekTo
+	p.seekTo = -1
+	p.position = frame
+	return frame, true
+}
+
+// How close to its known end a play has to get before running out early is
+// just taken as the end, since durations are only ever to the second
+const resumeSlack = 3 * time.Second
+
+// Frame to pick the current play back up from after its stream ran out early.
+// False if it wasn't early, the length isn't known, or it got skipped.
+func (p *GuildPlayer) resumeFrame() (int, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.current == nil || p.current.Duration == 0 || p.skipped {
+		return 0, false
+	}
+	left := p.current.Duration - time.Duration(p.position)*FRAMEDURATION
+	return p.position, left > resumeSlack
+}
+
+// Skipped - Checked by the frame loops to know when to bail out
+func (p *GuildPlayer) Skipped() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.skipped
+}
+
+// Settings - Copy of the current guild settings
+func (p *GuildPlayer) Settings() GuildSettings {
+	p.Lock()
+	defer p.Unlock()
+	return p.settings
+}
+
+// UpdateSettings - Applies fn to the guild settings and returns the result
+func (p *GuildPlayer) UpdateSettings(fn func(*GuildSettings)) GuildSettings {
+	p.Lock()
+	defer p.Unlock()
+	fn(&p.settings)
+	return p.settings
+}
+
+// Stops recording the voice connection we're leaving and throws away what it
+// heard, nothing from it belongs in a clip of the next one. Caller must hold
+// the lock.
+func (p *GuildPlayer) stopListening() {
+	if p.listenStop != nil {
+		close(p.listenStop)
+		p.listenStop = nil
+	}
+	p.recorder.clear()
+}
+
+func (p *GuildPlayer) recording() bool {
+	return p.Settings().Recording
+}
+
+// SetRecording - Turns recording on or off, throwing away what was recorded
+// when it goes off
+func (p *GuildPlayer) SetRecording(on bool) {
+	p.UpdateSettings(func(gs *GuildSettings) {
+		gs.Recording = on
+	})
+	if !on {
+		p.recorder.clear()
+	}
+}
+
+// Clip - The last window of voice mixed down to opus frames
+func (p *GuildPlayer) Clip(window time.Duration) ([][]byte, error) {
+	if !p.recording() {
+		return nil, errors.New("recording is off, turn it on with `recording`")
+	}
+	return p.recorder.mixdown(window)
+}
+
+// Returns true and resets the meme timer if enough time has passed since the
+// last gifPost
+func (p *GuildPlayer) claimMeme() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if time.Now().Before(p.lastMeme.Add(p.settings.MemeTimeout)) {
+		return false
+	}
+	p.lastMeme = time.Now()
+	return true
+}
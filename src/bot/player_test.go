@@ -0,0 +1,142 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestQueueOwnership(t *testing.T) {
+	player := getPlayer("ownership")
+	player.current = &Play{UserID: "a"}
+	player.queue = []*Play{{UserID: "a"}, {UserID: "b"}, {UserID: "a"}}
+
+	if _, err := player.Remove(1, 2, "a"); err != errNotYours {
+		t.Errorf("removing someone else's play: got %v, want errNotYours", err)
+	}
+	if _, err := player.SkipTo(3, "a"); err != errNotYours {
+		t.Errorf("skipping past someone else's play: got %v, want errNotYours", err)
+	}
+	if ok, err := player.SkipTo(2, "b"); ok || err != errNotYours {
+		t.Errorf("skipping someone else's current play: got %v %v, want errNotYours", ok, err)
+	}
+
+	if n, err := player.Remove(3, 3, "a"); n != 1 || err != nil {
+		t.Errorf("removing your own play: got %d %v", n, err)
+	}
+	if ok, err := player.SkipTo(2, "a"); !ok || err != nil {
+		t.Errorf("skipping past your own plays: got %v %v", ok, err)
+	}
+	if n, err := player.Remove(1, 1, ""); n != 1 || err != nil {
+		t.Errorf("DJ removing anything: got %d %v", n, err)
+	}
+}
+
+// A player for guildID with nothing left over from earlier tests
+func freshPlayer(guildID string) *GuildPlayer {
+	playersMu.Lock()
+	delete(players, guildID)
+	playersMu.Unlock()
+	return getPlayer(guildID)
+}
+
+// A paused player with current playing frame 42 and one more play queued
+func pausedPlayer(guildID string) (*GuildPlayer, *Play) {
+	player := freshPlayer(guildID)
+	current := &Play{GuildID: guildID, UserID: "a", Sound: createSound("a", 1, 0)}
+	player.enqueue(current)
+	player.enqueue(&Play{GuildID: guildID, UserID: "b", Sound: createSound("b", 1, 0)})
+	player.current = current
+	player.position = 42
+	player.Pause()
+	return player, current
+}
+
+func TestPauseResume(t *testing.T) {
+	defer func(timeout time.Duration) { PAUSETIMEOUT = timeout }(PAUSETIMEOUT)
+	PAUSETIMEOUT = 0
+
+	player, _ := pausedPlayer("pause-resume")
+	vc := &discordgo.VoiceConnection{OpusSend: make(chan []byte, 1)}
+	sent := make(chan bool, 1)
+	go func() {
+		sent <- player.send(vc, []byte{1})
+	}()
+
+	select {
+	case <-sent:
+		t.Fatal("sent while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	player.Resume()
+	select {
+	case ok := <-sent:
+		if !ok || len(vc.OpusSend) != 1 {
+			t.Errorf("resuming didn't send the frame")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("resuming didn't wake send")
+	}
+}
+
+func TestPauseTimeout(t *testing.T) {
+	defer func(timeout time.Duration, resume bool) {
+		PAUSETIMEOUT, PAUSERESUME = timeout, resume
+	}(PAUSETIMEOUT, PAUSERESUME)
+	PAUSETIMEOUT = 20 * time.Millisecond
+
+	t.Run("resume", func(t *testing.T) {
+		PAUSERESUME = true
+		player, _ := pausedPlayer("pause-timeout-resume")
+		vc := &discordgo.VoiceConnection{OpusSend: make(chan []byte, 1)}
+
+		if !player.send(vc, []byte{1}) || len(vc.OpusSend) != 1 {
+			t.Errorf("timing out didn't resume")
+		}
+		if player.Paused() || player.QueueLength() != 1 {
+			t.Errorf("got paused %v with %d queued, want resumed with 1", player.Paused(), player.QueueLength())
+		}
+	})
+
+	t.Run("leave", func(t *testing.T) {
+		PAUSERESUME = false
+		player, current := pausedPlayer("pause-timeout-leave")
+		vc := &discordgo.VoiceConnection{OpusSend: make(chan []byte, 1)}
+
+		if player.send(vc, []byte{1}) || len(vc.OpusSend) != 0 {
+			t.Fatalf("timing out kept playing")
+		}
+		if next := player.next(current); next != nil {
+			t.Errorf("got %v after timing out, want nothing until resumed", next)
+		}
+		if play := player.finish(nil); play != nil || player.Playing() {
+			t.Errorf("didn't leave after timing out")
+		}
+		_, _, queue := player.Queue()
+		if len(queue) != 2 || queue[0] != current {
+			t.Fatalf("got %d queued, want the paused play and the one after it", len(queue))
+		}
+	})
+
+	t.Run("resume before leaving", func(t *testing.T) {
+		PAUSERESUME = false
+		player, current := pausedPlayer("pause-timeout-back")
+		vc := &discordgo.VoiceConnection{OpusSend: make(chan []byte, 1)}
+
+		player.send(vc, []byte{1})
+		if !player.Resume() {
+			t.Fatal("couldn't resume after timing out")
+		}
+		if next := player.next(current); next != current {
+			t.Fatalf("got %v after resuming, want the paused play again", next)
+		}
+		player.nowPlaying(current, nil)
+		if frame, ok := player.takeSeek(); !ok || frame != 42 {
+			t.Errorf("picked back up at %d %v, want 42", frame, ok)
+		}
+		if player.QueueLength() != 1 {
+			t.Errorf("got %d queued, want 1", player.QueueLength())
+		}
+	})
+}
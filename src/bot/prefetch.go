@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// A stream pipe started ahead of time for the play after the current one, so
+// its first frames are ready the moment the current play ends
+type prefetch struct {
+	play *Play
+	sp   *streamPipe
+
+	// Filled by fill until PREFETCHBYTES is reached, only safe to touch
+	// once done is closed
+	frames [][]byte
+	size   int
+	err    error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Link behind a stream play, empty for anything else
+func streamLink(play *Play) string {
+	nameType := strings.Split(play.Sound.Name, "@")
+	if len(nameType) > 1 && nameType[1] == "stream" {
+		return nameType[0]
+	}
+	return ""
+}
+
+// Starts buffering play, which has to be a stream
+func startPrefetch(play *Play, settings GuildSettings) (*prefetch, error) {
+	sp, err := startStreamPipe(context.Background(), streamLink(play), 0, settings)
+	if err != nil {
+		return nil, err
+	}
+	return newPrefetch(play, sp), nil
+}
+
+// Buffers sp, already started for play
+func newPrefetch(play *Play, sp *streamPipe) *prefetch {
+	pf := &prefetch{
+		play: play,
+		sp:   sp,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go pf.fill()
+	return pf
+}
+
+func (pf *prefetch) fill() {
+	defer close(pf.done)
+
+	for {
+		select {
+		case <-pf.stop:
+			return
+		default:
+		}
+
+		// Once we're at the cap the pipe is just left waiting, it gets read
+		// from again when the play starts
+		if pf.size >= PREFETCHBYTES {
+			<-pf.stop
+			return
+		}
+
+		opus, err := pf.sp.next()
+		if err != nil {
+			pf.err = err
+			return
+		}
+		pf.frames = append(pf.frames, opus)
+		pf.size += len(opus)
+	}
+}
+
+// Stops buffering and hands over the pipe, with the buffered frames queued up
+// in front of it
+func (pf *prefetch) take() *streamPipe {
+	close(pf.stop)
+	<-pf.done
+
+	pf.sp.buffered = pf.frames
+	pf.sp.err = pf.err
+	return pf.sp
+}
+
+// Throws the prefetch away
+func (pf *prefetch) cancel() {
+	close(pf.stop)
+	pf.sp.kill()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"dca"
+)
+
+// A stream pipe playing frames three byte frames out of a file, standing in
+// for youtube-dl and ffmpeg. The file is for the caller to remove.
+func testStreamPipe(t *testing.T, frames int) (*streamPipe, string) {
+	file, err := ioutil.TempFile("", "prefetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	dw, _ := dca.NewWriter(file, nil)
+	for i := 0; i < frames; i++ {
+		dw.WriteFrame([]byte{0xf8, byte(i), 0xfe})
+	}
+
+	p := newPipeline(context.Background())
+	p.add("cat", file.Name())
+	sp, err := newStreamPipe(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sp, file.Name()
+}
+
+func TestPrefetchDue(t *testing.T) {
+	defer func(bytes int, ahead time.Duration) {
+		PREFETCHBYTES, PREFETCHAHEAD = bytes, ahead
+	}(PREFETCHBYTES, PREFETCHAHEAD)
+	PREFETCHAHEAD = 30 * time.Second
+
+	stream := &Play{Sound: createSound("https://youtu.be/next@stream", 1, 0)}
+	cached := &Play{Sound: createSound("next", 1, 0)}
+	tests := []struct {
+		name     string
+		bytes    int
+		repeat   RepeatMode
+		next     *Play
+		duration time.Duration
+		played   time.Duration
+		want     bool
+	}{
+		{"near the end", 1 << 20, RepeatOff, stream, time.Minute, 40 * time.Second, true},
+		{"far from the end", 1 << 20, RepeatOff, stream, time.Minute, 10 * time.Second, false},
+		{"unknown length", 1 << 20, RepeatOff, stream, 0, 0, true},
+		{"nothing queued", 1 << 20, RepeatOff, nil, time.Minute, 40 * time.Second, false},
+		{"cached next", 1 << 20, RepeatOff, cached, time.Minute, 40 * time.Second, false},
+		{"looping the track", 1 << 20, RepeatTrack, stream, time.Minute, 40 * time.Second, false},
+		{"disabled", 0, RepeatOff, stream, time.Minute, 40 * time.Second, false},
+	}
+	for _, tt := range tests {
+		PREFETCHBYTES = tt.bytes
+		player := freshPlayer("prefetch-due")
+		player.settings.Repeat = tt.repeat
+		player.current = &Play{Duration: tt.duration}
+		player.position = int(tt.played / FRAMEDURATION)
+		if tt.next != nil {
+			player.queue = []*Play{tt.next}
+		}
+
+		if got := player.prefetchDue(); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		player.prefetching = true
+		if player.prefetchDue() {
+			t.Errorf("%s: due again while one is starting", tt.name)
+		}
+	}
+}
+
+// Buffering stops at PREFETCHBYTES and the rest is left in the pipe
+func TestPrefetchCap(t *testing.T) {
+	defer func(bytes int) { PREFETCHBYTES = bytes }(PREFETCHBYTES)
+	PREFETCHBYTES = 30
+
+	sp, path := testStreamPipe(t, 50)
+	defer os.Remove(path)
+	pf := newPrefetch(&Play{}, sp)
+
+	// Plenty of time for cat to hand over more than fits
+	time.Sleep(200 * time.Millisecond)
+	sp = pf.take()
+	defer sp.kill()
+	if len(sp.buffered) != 10 {
+		t.Errorf("buffered %d frames, want the 10 that fit", len(sp.buffered))
+	}
+
+	frames := 0
+	for {
+		if _, err := sp.next(); err != nil {
+			break
+		}
+		frames++
+	}
+	if frames != 50 {
+		t.Errorf("got %d frames after the handoff, want all 50", frames)
+	}
+}
+
+func TestPrefetchHandoff(t *testing.T) {
+	player := freshPlayer("prefetch-handoff")
+	current := &Play{Sound: createSound("https://youtu.be/current@stream", 1, 0)}
+	next := &Play{Sound: createSound("https://youtu.be/next@stream", 1, 0)}
+	player.current = current
+	player.queue = []*Play{next}
+	sp, path := testStreamPipe(t, 5)
+	defer os.Remove(path)
+	player.prefetch = newPrefetch(next, sp)
+
+	// Restarting the current play mustn't touch the next one's buffer
+	if player.takePrefetch(current.Sound) != nil {
+		t.Fatal("took the next play's prefetch for the current one")
+	}
+	if player.prefetch == nil {
+		t.Fatal("restarting the current play dropped the next one's prefetch")
+	}
+
+	player.queue = nil
+	player.nowPlaying(next, nil)
+	if sp = player.takePrefetch(next.Sound); sp == nil {
+		t.Fatal("next play didn't get its prefetch")
+	}
+	sp.kill()
+	if player.prefetch != nil {
+		t.Error("prefetch still around after the handoff")
+	}
+}
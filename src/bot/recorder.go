@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+	"github.com/layeh/gopus"
+)
+
+// An opus frame someone sent, and when it got here
+type recordedFrame struct {
+	at   time.Time
+	opus []byte
+}
+
+// Rolling record of the last RECORDLENGTH of what everyone said in the
+// guild's voice channel, kept per speaker so it can be mixed down on demand
+type voiceRecorder struct {
+	sync.Mutex
+	speakers map[uint32][]recordedFrame
+}
+
+func newVoiceRecorder() *voiceRecorder {
+	return &voiceRecorder{speakers: make(map[uint32][]recordedFrame)}
+}
+
+// Channel vc hands received voice to, nil if it has none. discordgo sets it
+// up from its own goroutine, so it's only read under vc's lock and only once
+// the connection is ready.
+func opusRecv(vc *discordgo.VoiceConnection) <-chan *discordgo.Packet {
+	if vc == nil {
+		return nil
+	}
+	vc.RLock()
+	defer vc.RUnlock()
+	if !vc.Ready {
+		return nil
+	}
+	return vc.OpusRecv
+}
+
+// Keeps whatever comes in on recv while enabled says to, until stop is closed
+func (r *voiceRecorder) listen(recv <-chan *discordgo.Packet, stop chan struct{}, enabled func() bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case pkt, ok := <-recv:
+			if !ok {
+				return
+			}
+			if enabled() {
+				r.add(pkt, time.Now())
+			}
+		}
+	}
+}
+
+// Records pkt as arriving at at, dropping whatever that pushes out of the
+// window
+func (r *voiceRecorder) add(pkt *discordgo.Packet, at time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	frames := append(r.speakers[pkt.SSRC], recordedFrame{at: at, opus: pkt.Opus})
+	cut := 0
+	for cut < len(frames) && at.Sub(frames[cut].at) > RECORDLENGTH {
+		cut++
+	}
+	r.speakers[pkt.SSRC] = frames[cut:]
+}
+
+// Throws away everything recorded so far
+func (r *voiceRecorder) clear() {
+	r.Lock()
+	r.speakers = make(map[uint32][]recordedFrame)
+	r.Unlock()
+}
+
+// Mixes the last window of every speaker down into one track of opus frames,
+// from whoever spoke first to whoever spoke last
+func (r *voiceRecorder) mixdown(window time.Duration) ([][]byte, error) {
+	since := time.Now().Add(-window)
+
+	// Copy out what we need so decoding doesn't hold up receiving
+	r.Lock()
+	var start, end time.Time
+	speakers := make(map[uint32][]recordedFrame)
+	for ssrc, frames := range r.speakers {
+		i := 0
+		for i < len(frames) && frames[i].at.Before(since) {
+			i++
+		}
+		if i == len(frames) {
+			continue
+		}
+		speakers[ssrc] = append([]recordedFrame(nil), frames[i:]...)
+		if first := frames[i].at; start.IsZero() || first.Before(start) {
+			start = first
+		}
+		if last := frames[len(frames)-1].at; last.After(end) {
+			end = last
+		}
+	}
+	r.Unlock()
+
+	if len(speakers) == 0 {
+		return nil, errors.New("nobody has said anything")
+	}
+
+	frameSamples := opusFrameSize * opusChannels
+	slots := int(end.Sub(start)/FRAMEDURATION) + 1
+	mix := make([]int32, slots*frameSamples)
+
+	for _, frames := range speakers {
+		decoder, err := gopus.NewDecoder(opusSampleRate, opusChannels)
+		if err != nil {
+			return nil, err
+		}
+
+		// Frames go in the slot they arrived in, unless jitter bunched them
+		// up and the slot is already taken
+		slot := -1
+		for _, f := range frames {
+			s := int(f.at.Sub(start) / FRAMEDURATION)
+			if s <= slot {
+				s = slot + 1
+			}
+			if s >= slots {
+				break
+			}
+			slot = s
+
+			pcm, err := decoder.Decode(f.opus, opusFrameSize, false)
+			if err != nil {
+				continue
+			}
+			base := s * frameSamples
+			for i, sample := range pcm {
+				if i >= frameSamples {
+					break
+				}
+				mix[base+i] += int32(sample)
+			}
+		}
+	}
+
+	encoder, err := gopus.NewEncoder(opusSampleRate, opusChannels, gopus.Audio)
+	if err != nil {
+		return nil, err
+	}
+	encoder.SetBitrate(BITRATE * 1000)
+
+	out := make([][]byte, 0, slots)
+	pcm := make([]int16, frameSamples)
+	for s := 0; s < slots; s++ {
+		for i := range pcm {
+			pcm[i] = clip16(mix[s*frameSamples+i])
+		}
+		opus, err := encoder.Encode(pcm, opusFrameSize, opusMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, opus)
+	}
+	return out, nil
+}
+
+// Lets the guild know voice is being kept, every time the bot joins or moves
+// voice channel with recording on. Nobody should get recorded without knowing
+// about it, however the play that brought the bot in was asked for.
+func announceRecording(player *GuildPlayer, play *Play) {
+	if !player.recording() {
+		return
+	}
+	channelID := play.TextChannelID
+	if channelID == "" {
+		channelID = player.TextChannel()
+	}
+	discord.ChannelMessageSend(channelID, "Heads up, recording is on in this server. The last "+durationFormat(RECORDLENGTH)+" of voice is kept for `clip`, `recording` turns it off")
+}
+
+// Saves the last window of voice in g as a tag, telling the channel who did
+func clipVoice(s *discordgo.Session, m *discordgo.MessageCreate, g *discordgo.Guild, window time.Duration, tag string) {
+	tagDCA := "tag_" + tag + ".dca"
+	if fileExists(tagDCA) {
+		s.ChannelMessageSend(m.ChannelID, tag+" already exists")
+		return
+	}
+
+	frames, err := getPlayer(g.ID).Clip(window)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error())
+		return
+	}
+	meta := newDCAMetadata("voice clip "+tag, "voice", "", m.Author.Username)
+	if err = writeDCAFile("audio/"+tagDCA, meta, frames); err != nil {
+		log.Println("clip write err:", err)
+		s.ChannelMessageSend(m.ChannelID, "Error: couldn't save the clip")
+		return
+	}
+
+	length := time.Duration(len(frames)) * FRAMEDURATION
+	s.ChannelMessageSend(m.ChannelID, m.Author.Username+" clipped the last "+durationFormat(length)+" of voice as tag "+tag)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestRecorderWindow(t *testing.T) {
+	defer func(length time.Duration) { RECORDLENGTH = length }(RECORDLENGTH)
+	RECORDLENGTH = time.Second
+
+	r := newVoiceRecorder()
+	start := time.Now()
+	tests := []struct {
+		ssrc  uint32
+		after time.Duration
+		want  int
+	}{
+		{1, 0, 1},
+		{1, 500 * time.Millisecond, 2},
+		{2, 900 * time.Millisecond, 1},
+		{1, time.Second, 3},
+		// Only pushes out what's older than the window, and only for ssrc 1
+		{1, 1200 * time.Millisecond, 3},
+		{1, 2100 * time.Millisecond, 2},
+		{1, 4 * time.Second, 1},
+	}
+	for _, tt := range tests {
+		r.add(&discordgo.Packet{SSRC: tt.ssrc}, start.Add(tt.after))
+		if got := len(r.speakers[tt.ssrc]); got != tt.want {
+			t.Errorf("ssrc %d at %v: kept %d frames, want %d", tt.ssrc, tt.after, got, tt.want)
+		}
+	}
+	if got := len(r.speakers[2]); got != 1 {
+		t.Errorf("ssrc 2 kept %d frames, want its 1", got)
+	}
+
+	r.clear()
+	if len(r.speakers) != 0 {
+		t.Errorf("clear left %d speakers", len(r.speakers))
+	}
+}
+
+func TestMixdown(t *testing.T) {
+	defer func(length time.Duration) { RECORDLENGTH = length }(RECORDLENGTH)
+	RECORDLENGTH = time.Minute
+
+	r := newVoiceRecorder()
+	if _, err := r.mixdown(time.Minute); err == nil {
+		t.Error("mixed down a recording of nobody")
+	}
+
+	now := time.Now()
+	r.add(&discordgo.Packet{SSRC: 1}, now.Add(-10*time.Second))
+	r.add(&discordgo.Packet{SSRC: 1}, now.Add(-time.Second))
+	r.add(&discordgo.Packet{SSRC: 2}, now.Add(-time.Second+FRAMEDURATION))
+	r.add(&discordgo.Packet{SSRC: 2}, now.Add(-time.Second+9*FRAMEDURATION))
+
+	tests := []struct {
+		name   string
+		window time.Duration
+		want   int
+	}{
+		{"everything", time.Minute, int((9*time.Second+9*FRAMEDURATION)/FRAMEDURATION) + 1},
+		{"last two seconds", 2 * time.Second, 10},
+	}
+	for _, tt := range tests {
+		frames, err := r.mixdown(tt.window)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(frames) != tt.want {
+			t.Errorf("%s: got %d frames, want %d", tt.name, len(frames), tt.want)
+		}
+	}
+
+	if _, err := r.mixdown(500 * time.Millisecond); err == nil {
+		t.Error("mixed down a window nobody spoke in")
+	}
+}
+
+func TestRecorderListen(t *testing.T) {
+	r := newVoiceRecorder()
+	recv := make(chan *discordgo.Packet)
+	stop := make(chan struct{})
+	enabled := make(chan bool, 1)
+	done := make(chan struct{})
+	go func() {
+		r.listen(recv, stop, func() bool { return <-enabled })
+		close(done)
+	}()
+
+	enabled <- true
+	recv <- &discordgo.Packet{SSRC: 1}
+	enabled <- false
+	recv <- &discordgo.Packet{SSRC: 2}
+	close(stop)
+	<-done
+
+	r.Lock()
+	defer r.Unlock()
+	if len(r.speakers[1]) != 1 || len(r.speakers[2]) != 0 {
+		t.Errorf("kept %d and %d frames, want only the one sent while enabled", len(r.speakers[1]), len(r.speakers[2]))
+	}
+}
+
+func TestStopListeningClears(t *testing.T) {
+	player := freshPlayer("stop-listening")
+	player.recorder.add(&discordgo.Packet{SSRC: 1}, time.Now())
+	player.listenStop = make(chan struct{})
+	stop := player.listenStop
+
+	player.Lock()
+	player.stopListening()
+	player.Unlock()
+
+	select {
+	case <-stop:
+	default:
+		t.Error("listener wasn't told to stop")
+	}
+	if _, err := player.recorder.mixdown(RECORDLENGTH); err == nil {
+		t.Error("what the old connection heard is still there to clip")
+	}
+}
+
+func TestOpusRecv(t *testing.T) {
+	recv := make(chan *discordgo.Packet)
+	vc := &discordgo.VoiceConnection{OpusRecv: recv}
+	if opusRecv(nil) != nil || opusRecv(vc) != nil {
+		t.Error("got a receive channel from a connection that isn't ready")
+	}
+	vc.Ready = true
+	if opusRecv(vc) != (<-chan *discordgo.Packet)(recv) {
+		t.Error("didn't get the ready connection's receive channel")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		length string
+		want   time.Duration
+		ok     bool
+	}{
+		{"0", 0, true},
+		{"0:00", 0, true},
+		{"00:00", 0, true},
+		{"1:23", 83 * time.Second, true},
+		{"1:02:03", time.Hour + 2*time.Minute + 3*time.Second, true},
+		{"PT0S", 0, true},
+		{"PT1H2M3S", time.Hour + 2*time.Minute + 3*time.Second, true},
+		{"P1DT1S", 24*time.Hour + time.Second, true},
+		{"", 0, false},
+		{"0s", 0, false},
+		{"1:x", 0, false},
+		{"1:-5", 0, false},
+		{"P", 0, false},
+		{"PT1X", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseDuration(tt.length)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%q: got %v %v, want %v %v", tt.length, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+var seekTests = []struct {
+	name     string
+	position int
+	offset   time.Duration
+	relative bool
+	want     int
+}{
+	{"start", 30, 0, false, 0},
+	{"absolute", 30, 10 * FRAMEDURATION, false, 10},
+	{"forwards", 10, 5 * FRAMEDURATION, true, 15},
+	{"backwards", 30, -5 * FRAMEDURATION, true, 25},
+	{"before the start", 10, -time.Minute, true, 0},
+}
+
+// A player partway through play, seeked the way the seek command would
+func seekedPlayer(t *testing.T, guildID string, position int, offset time.Duration, relative bool) *GuildPlayer {
+	player := freshPlayer(guildID)
+	player.current = &Play{Sound: createSound("seek", 1, 0)}
+	player.position = position
+	if !player.Seek(offset, relative) {
+		t.Fatal("nothing to seek in")
+	}
+	return player
+}
+
+func TestSeek(t *testing.T) {
+	if freshPlayer("seek-idle").Seek(time.Second, false) {
+		t.Error("seeked with nothing playing")
+	}
+
+	for _, tt := range seekTests {
+		player := seekedPlayer(t, "seek", tt.position, tt.offset, tt.relative)
+		frame, ok := player.takeSeek()
+		if !ok || frame != tt.want {
+			t.Errorf("%s: got frame %d %v, want %d", tt.name, frame, ok, tt.want)
+		}
+		if player.position != tt.want {
+			t.Errorf("%s: position %d after seeking, want %d", tt.name, player.position, tt.want)
+		}
+		if _, ok = player.takeSeek(); ok {
+			t.Errorf("%s: seeked twice", tt.name)
+		}
+	}
+}
+
+// Seeking a cached DCA sound, both out of memory and read off disk
+func TestSeekCached(t *testing.T) {
+	defer func(clip int) { CACHECLIPBYTES = clip }(CACHECLIPBYTES)
+	dir, err := ioutil.TempDir("", "seek")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var frames [][]byte
+	for i := 0; i < 50; i++ {
+		frames = append(frames, []byte{0xf8, byte(i), 0xfe})
+	}
+
+	for _, mode := range []struct {
+		name string
+		clip int
+	}{{"memory", 1 << 20}, {"disk", 0}} {
+		CACHECLIPBYTES = mode.clip
+		// A file of its own, the cache would hand the other one out of memory
+		path := filepath.Join(dir, mode.name+".dca")
+		if err = writeDCAFile(path, newDCAMetadata("seek", "file", "", ""), frames); err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range seekTests {
+			sf, err := openSound(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Get to where the play is before seeking from there
+			for i := 0; i < tt.position; i++ {
+				sf.next()
+			}
+			if (sf.dr == nil) != (mode.clip > 0) {
+				t.Fatalf("%s: wrong kind of sound", mode.name)
+			}
+
+			player := seekedPlayer(t, "seek-cached", tt.position, tt.offset, tt.relative)
+			frame, _ := player.takeSeek()
+			if err = sf.seek(frame); err != nil {
+				t.Fatalf("%s %s: %v", mode.name, tt.name, err)
+			}
+			if opus, err := sf.next(); err != nil || opus[1] != byte(tt.want) {
+				t.Errorf("%s %s: got %v %v, want frame %d", mode.name, tt.name, opus, err, tt.want)
+			}
+			sf.close()
+		}
+
+		// Past the end just finishes it
+		sf, _ := openSound(path)
+		sf.seek(80)
+		if _, err = sf.next(); err != io.EOF {
+			t.Errorf("%s: got %v past the end, want io.EOF", mode.name, err)
+		}
+		sf.close()
+	}
+}
+
+// Seeking a stream hands the frame back to restart the pipe from, with ffmpeg
+// jumping straight there
+func TestSeekStream(t *testing.T) {
+	defer func(depth time.Duration) { JITTERDEPTH = depth }(JITTERDEPTH)
+	JITTERDEPTH = 0
+
+	for _, tt := range seekTests {
+		player := seekedPlayer(t, "seek-stream", tt.position, tt.offset, tt.relative)
+		sp, path := testStreamPipe(t, 5)
+		frame, err := player.current.Sound.playFrames(nil, player, sp)
+		sp.kill()
+		os.Remove(path)
+		if frame != tt.want || err != nil {
+			t.Errorf("%s: restarting at %d %v, want %d", tt.name, frame, err, tt.want)
+		}
+
+		args := ffmpegArgs("in", time.Duration(frame)*FRAMEDURATION, GuildSettings{Volume: 100})
+		if tt.want == 0 {
+			if args[0] != "-i" {
+				t.Errorf("%s: got %v, want no seek", tt.name, args)
+			}
+		} else if want := (time.Duration(tt.want) * FRAMEDURATION).Seconds(); args[0] != "-ss" || args[1] != strconv.FormatFloat(want, 'f', 2, 64) {
+			t.Errorf("%s: got %v, want -ss %v", tt.name, args, want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dca"
+)
+
+// Rough cost of holding on to a frame besides its bytes, the slice header
+const cachedFrameOverhead = 24
+
+// Short sounds that played recently, kept in memory up to CACHEBYTES.
+// Anything bigger than CACHECLIPBYTES never goes in and gets read off disk
+// as it plays instead.
+var sounds = &soundCache{
+	entries: make(map[string]*list.Element),
+	order:   list.New(),
+}
+
+// Hit and miss counts for status
+var (
+	soundCacheHits   int64
+	soundCacheMisses int64
+)
+
+type soundCache struct {
+	sync.Mutex
+
+	// Front is the most recently played
+	entries map[string]*list.Element
+	order   *list.List
+	size    int64
+}
+
+type cachedSound struct {
+	path     string
+	frames   [][]byte
+	size     int64
+	modTime  time.Time
+	fileSize int64
+}
+
+// Frames of the file at path, nil if it's too big for the cache and should be
+// read off disk instead. Counts as a hit or miss, so only playing calls it.
+func (c *soundCache) frames(path string) ([][]byte, error) {
+	return c.get(path, true)
+}
+
+// Frames of the file at path if they're cached already, nil if not. Neither
+// counts towards the hit rate nor loads anything, for looking at a sound
+// before it plays.
+func (c *soundCache) peek(path string) ([][]byte, error) {
+	return c.get(path, false)
+}
+
+func (c *soundCache) get(path string, play bool) ([][]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	if e, ok := c.entries[path]; ok {
+		cs := e.Value.(*cachedSound)
+		// Tags get recorded over and files get repaired, so only trust an
+		// entry while the file is unchanged
+		if cs.fileSize == info.Size() && cs.modTime.Equal(info.ModTime()) {
+			c.order.MoveToFront(e)
+			c.Unlock()
+			if play {
+				atomic.AddInt64(&soundCacheHits, 1)
+			}
+			return cs.frames, nil
+		}
+		c.remove(e)
+	}
+	c.Unlock()
+
+	if !play {
+		return nil, nil
+	}
+	atomic.AddInt64(&soundCacheMisses, 1)
+	if info.Size() > int64(CACHECLIPBYTES) || info.Size() > int64(CACHEBYTES) {
+		return nil, nil
+	}
+
+	frames, err := loadFrames(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cs := &cachedSound{path: path, frames: frames, modTime: info.ModTime(), fileSize: info.Size()}
+	for _, opus := range frames {
+		cs.size += int64(len(opus)) + cachedFrameOverhead
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[path]; ok {
+		// Someone else loaded it while we were
+		c.remove(e)
+	}
+	c.entries[path] = c.order.PushFront(cs)
+	c.size += cs.size
+	for c.size > int64(CACHEBYTES) && c.order.Len() > 1 {
+		c.remove(c.order.Back())
+	}
+	return frames, nil
+}
+
+// Caller must hold the lock
+func (c *soundCache) remove(e *list.Element) {
+	cs := c.order.Remove(e).(*cachedSound)
+	delete(c.entries, cs.path)
+	c.size -= cs.size
+}
+
+// How much is cached and how many sounds that is
+func (c *soundCache) usage() (int64, int) {
+	c.Lock()
+	defer c.Unlock()
+	return c.size, c.order.Len()
+}
+
+// Frames of a sound being played, out of the cache or straight off disk
+type soundFrames struct {
+	path   string
+	frames [][]byte
+	pos    int
+
+	file *os.File
+	dr   *dca.Reader
+}
+
+// Opens the sound at path, from the cache if it's short enough
+func openSound(path string) (*soundFrames, error) {
+	frames, err := sounds.frames(path)
+	if err != nil {
+		return nil, err
+	}
+	sf := &soundFrames{path: path, frames: frames}
+	if frames == nil {
+		if err = sf.open(); err != nil {
+			return nil, err
+		}
+	}
+	return sf, nil
+}
+
+func (sf *soundFrames) open() error {
+	file, err := os.Open(sf.path)
+	if err != nil {
+		return err
+	}
+	dr, err := dca.NewReader(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	sf.file, sf.dr, sf.pos = file, dr, 0
+	return nil
+}
+
+// Next frame, io.EOF at the end. Damaged frames get skipped the same as when
+// loading the whole file.
+func (sf *soundFrames) next() ([]byte, error) {
+	if sf.dr == nil {
+		if sf.pos >= len(sf.frames) {
+			return nil, io.EOF
+		}
+		sf.pos++
+		return sf.frames[sf.pos-1], nil
+	}
+
+	opus, err := nextGoodFrame(sf.dr, sf.path)
+	if err != nil {
+		return nil, err
+	}
+	sf.pos++
+	return opus, nil
+}
+
+// Jumps to frame, reopening the file when going backwards on disk
+func (sf *soundFrames) seek(frame int) error {
+	if sf.dr == nil {
+		sf.pos = frame
+		return nil
+	}
+
+	if frame < sf.pos {
+		sf.file.Close()
+		if err := sf.open(); err != nil {
+			sf.dr = nil
+			sf.frames = nil
+			return err
+		}
+	}
+	for sf.pos < frame {
+		if _, err := sf.dr.Skip(); err != nil {
+			break
+		}
+		sf.pos++
+	}
+	return nil
+}
+
+func (sf *soundFrames) close() {
+	if sf.file != nil {
+		sf.file.Close()
+	}
+}
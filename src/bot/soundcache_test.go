@@ -0,0 +1,211 @@
+package main
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Cost in the cache of the sounds writeSound writes
+func soundSize(frames int) int64 {
+	return int64(frames) * (3 + cachedFrameOverhead)
+}
+
+// Writes a sound frames long to name in dir, returning its path
+func writeSound(t *testing.T, dir, name string, frames int) string {
+	var opus [][]byte
+	for i := 0; i < frames; i++ {
+		opus = append(opus, []byte{0xf8, byte(i), 0xfe})
+	}
+	path := filepath.Join(dir, name)
+	if err := writeDCAFile(path, newDCAMetadata(name, "file", "", ""), opus); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestCache(t *testing.T) (*soundCache, string) {
+	dir, err := ioutil.TempDir("", "soundcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &soundCache{entries: make(map[string]*list.Element), order: list.New()}, dir
+}
+
+// Whether each name has an entry in c
+func cached(c *soundCache, dir string, names ...string) []bool {
+	c.Lock()
+	defer c.Unlock()
+	var in []bool
+	for _, name := range names {
+		_, ok := c.entries[filepath.Join(dir, name)]
+		in = append(in, ok)
+	}
+	return in
+}
+
+func TestSoundCacheLRU(t *testing.T) {
+	defer func(bytes, clip int) {
+		CACHEBYTES, CACHECLIPBYTES = bytes, clip
+	}(CACHEBYTES, CACHECLIPBYTES)
+	CACHEBYTES = int(2 * soundSize(10))
+	CACHECLIPBYTES = 1 << 20
+
+	c, dir := newTestCache(t)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a", "b", "c"} {
+		writeSound(t, dir, name, 10)
+	}
+
+	tests := []struct {
+		sound  string
+		peek   bool
+		hit    bool
+		loaded bool
+		want   [3]bool
+	}{
+		{"a", false, false, true, [3]bool{true, false, false}},
+		{"b", false, false, true, [3]bool{true, true, false}},
+		{"a", false, true, true, [3]bool{true, true, false}},
+		// b is the least recently played now, so it makes room
+		{"c", false, false, true, [3]bool{true, false, true}},
+		{"b", true, false, false, [3]bool{true, false, true}},
+		{"c", true, true, true, [3]bool{true, false, true}},
+		// Peeking doesn't count as playing, c is still the newest
+		{"b", false, false, true, [3]bool{false, true, true}},
+	}
+	for i, tt := range tests {
+		hits, misses := atomic.LoadInt64(&soundCacheHits), atomic.LoadInt64(&soundCacheMisses)
+		get := c.frames
+		if tt.peek {
+			get = c.peek
+		}
+		frames, err := get(filepath.Join(dir, tt.sound))
+		if err != nil {
+			t.Fatalf("%d %s: %v", i, tt.sound, err)
+		}
+		if loaded := frames != nil; loaded != tt.loaded {
+			t.Errorf("%d %s: got frames %v, want %v", i, tt.sound, loaded, tt.loaded)
+		}
+
+		wantHits, wantMisses := int64(0), int64(0)
+		if !tt.peek && tt.hit {
+			wantHits = 1
+		} else if !tt.peek {
+			wantMisses = 1
+		}
+		if got := atomic.LoadInt64(&soundCacheHits) - hits; got != wantHits {
+			t.Errorf("%d %s: counted %d hits, want %d", i, tt.sound, got, wantHits)
+		}
+		if got := atomic.LoadInt64(&soundCacheMisses) - misses; got != wantMisses {
+			t.Errorf("%d %s: counted %d misses, want %d", i, tt.sound, got, wantMisses)
+		}
+
+		in := cached(c, dir, "a", "b", "c")
+		if [3]bool{in[0], in[1], in[2]} != tt.want {
+			t.Errorf("%d %s: cached %v, want %v", i, tt.sound, in, tt.want)
+		}
+	}
+
+	if size, n := c.usage(); size != 2*soundSize(10) || n != 2 {
+		t.Errorf("using %d bytes in %d sounds, want %d in 2", size, n, 2*soundSize(10))
+	}
+}
+
+// Tags get recorded over and files repaired, the cache mustn't keep playing
+// the old version
+func TestSoundCacheInvalidation(t *testing.T) {
+	defer func(bytes, clip int) {
+		CACHEBYTES, CACHECLIPBYTES = bytes, clip
+	}(CACHEBYTES, CACHECLIPBYTES)
+	CACHEBYTES, CACHECLIPBYTES = 1<<20, 1<<20
+
+	tests := []struct {
+		name   string
+		change func(t *testing.T, dir, path string)
+		want   int
+	}{
+		{"unchanged", func(t *testing.T, dir, path string) {}, 10},
+		{"different size", func(t *testing.T, dir, path string) {
+			writeSound(t, dir, "sound", 20)
+		}, 20},
+		{"touched", func(t *testing.T, dir, path string) {
+			later := time.Now().Add(time.Hour)
+			if err := os.Chtimes(path, later, later); err != nil {
+				t.Fatal(err)
+			}
+		}, 10},
+	}
+	for _, tt := range tests {
+		c, dir := newTestCache(t)
+		path := writeSound(t, dir, "sound", 10)
+		if _, err := c.frames(path); err != nil {
+			t.Fatal(err)
+		}
+
+		tt.change(t, dir, path)
+		hits := atomic.LoadInt64(&soundCacheHits)
+		frames, err := c.frames(path)
+		if err != nil || len(frames) != tt.want {
+			t.Errorf("%s: got %d frames %v, want %d", tt.name, len(frames), err, tt.want)
+		}
+		wantHits := int64(0)
+		if tt.name == "unchanged" {
+			wantHits = 1
+		}
+		if got := atomic.LoadInt64(&soundCacheHits) - hits; got != wantHits {
+			t.Errorf("%s: counted %d hits, want %d", tt.name, got, wantHits)
+		}
+		if size, n := c.usage(); size != soundSize(tt.want) || n != 1 {
+			t.Errorf("%s: using %d bytes in %d sounds, want the new one only", tt.name, size, n)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// Sounds over CACHECLIPBYTES get read off disk every time, and still play
+func TestSoundCacheClipBypass(t *testing.T) {
+	defer func(bytes, clip int) {
+		CACHEBYTES, CACHECLIPBYTES = bytes, clip
+	}(CACHEBYTES, CACHECLIPBYTES)
+	CACHEBYTES = 1 << 20
+
+	c, dir := newTestCache(t)
+	defer os.RemoveAll(dir)
+	path := writeSound(t, dir, "long", 50)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		clip int64
+		want bool
+	}{
+		{"too long", info.Size() - 1, false},
+		{"just fits", info.Size(), true},
+	}
+	for _, tt := range tests {
+		CACHECLIPBYTES = int(tt.clip)
+		c.Lock()
+		c.entries, c.order, c.size = make(map[string]*list.Element), list.New(), 0
+		c.Unlock()
+
+		misses := atomic.LoadInt64(&soundCacheMisses)
+		frames, err := c.frames(path)
+		if err != nil || (frames != nil) != tt.want {
+			t.Errorf("%s: got frames %v %v, want %v", tt.name, frames != nil, err, tt.want)
+		}
+		if got := atomic.LoadInt64(&soundCacheMisses) - misses; got != 1 {
+			t.Errorf("%s: counted %d misses, want 1", tt.name, got)
+		}
+		if in := cached(c, dir, "long"); in[0] != tt.want {
+			t.Errorf("%s: cached %v, want %v", tt.name, in[0], tt.want)
+		}
+	}
+}
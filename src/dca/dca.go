@@ -0,0 +1,79 @@
+// Package dca reads and writes DCA audio files: 20ms Opus frames, each
+// prefixed with its length as a little endian int16, optionally preceded by
+// a DCA1 metadata header. Files without the header are the legacy raw format
+// and are read the same way.
+package dca
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// FrameDuration - How much audio every frame holds
+	FrameDuration = 20 * time.Millisecond
+
+	// MaxFrameSize - Largest frame a length prefix may announce, a 20ms
+	// 48kHz stereo frame never comes close
+	MaxFrameSize = 4000
+)
+
+// ErrBadLength - A length prefix that can't belong to a real frame
+var ErrBadLength = errors.New("dca: bad frame length")
+
+// FrameError - Where in a file reading a frame failed. Offset is where the
+// frame's length prefix starts, everything before it is good.
+type FrameError struct {
+	Frame  int
+	Offset int64
+	Err    error
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("dca: frame %d at byte %d: %v", e.Frame, e.Offset, e.Err)
+}
+
+// Duration - How long frames frames play for
+func Duration(frames int) time.Duration {
+	return time.Duration(frames) * FrameDuration
+}
+
+// CountFrames - Number of frames in r, without keeping any of them. Stops at
+// the first bad frame.
+func CountFrames(r io.Reader) (int, error) {
+	dr, err := NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		if _, err = dr.Skip(); err == io.EOF {
+			return dr.Frames(), nil
+		} else if err != nil {
+			return dr.Frames(), err
+		}
+	}
+}
+
+// Validate - Reads all of r, checking every length prefix and Opus packet.
+// Returns the number of good frames and a *FrameError for the first frame
+// that isn't.
+func Validate(r io.Reader) (int, error) {
+	dr, err := NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		offset := dr.Offset()
+		opus, err := dr.ReadFrame()
+		if err == io.EOF {
+			return dr.Frames(), nil
+		} else if err != nil {
+			return dr.Frames(), err
+		}
+		if err = CheckPacket(opus); err != nil {
+			return dr.Frames() - 1, &FrameError{Frame: dr.Frames() - 1, Offset: offset, Err: err}
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package dca
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// The sounds shipped in audio/, which every change here has to keep reading
+func seedFiles(t *testing.T) map[string][]byte {
+	paths, err := filepath.Glob("../../audio/*.dca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Skip("no dca files in audio/")
+	}
+
+	files := make(map[string][]byte)
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[filepath.Base(path)] = data
+	}
+	return files
+}
+
+// Reads every frame out of data, failing the test on anything that isn't
+// io.EOF or a *FrameError
+func readAll(t *testing.T, data []byte) ([][]byte, *Reader, error) {
+	dr, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var frames [][]byte
+	for {
+		opus, err := dr.ReadFrame()
+		if err == io.EOF {
+			return frames, dr, nil
+		}
+		if err != nil {
+			if _, ok := err.(*FrameError); !ok {
+				t.Fatalf("got %T %v, want *FrameError", err, err)
+			}
+			if dr.Offset() > int64(len(data)) {
+				t.Fatalf("offset %d past the end of %d bytes", dr.Offset(), len(data))
+			}
+			return frames, dr, err
+		}
+		frames = append(frames, opus)
+	}
+}
+
+func TestAudioFiles(t *testing.T) {
+	for name, data := range seedFiles(t) {
+		frames, err := Validate(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if frames == 0 {
+			t.Errorf("%s: no frames", name)
+		}
+
+		// Legacy files have to come back byte for byte
+		read, dr, err := readAll(t, data)
+		if err != nil || dr.Metadata != nil {
+			continue
+		}
+		var out bytes.Buffer
+		dw, _ := NewWriter(&out, nil)
+		for _, opus := range read {
+			if err = dw.WriteFrame(opus); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Errorf("%s: frames changed on the way through", name)
+		}
+	}
+}
+
+func TestBadLengths(t *testing.T) {
+	frame := func(size int16, body int) []byte {
+		b := make([]byte, 2+body)
+		binary.LittleEndian.PutUint16(b, uint16(size))
+		return b
+	}
+
+	good := frame(3, 3)
+	cases := map[string][]byte{
+		"negative":  append(append([]byte{}, good...), frame(-5, 0)...),
+		"zero":      append(append([]byte{}, good...), frame(0, 0)...),
+		"too large": append(append([]byte{}, good...), frame(MaxFrameSize+1, 0)...),
+		"truncated": append(append([]byte{}, good...), frame(10, 4)...),
+		"half size": append(append([]byte{}, good...), 7),
+	}
+	for name, data := range cases {
+		frames, err := Validate(bytes.NewReader(data))
+		ferr, ok := err.(*FrameError)
+		if !ok {
+			t.Errorf("%s: got %v, want a *FrameError", name, err)
+			continue
+		}
+		if frames != 1 || ferr.Frame != 1 || ferr.Offset != int64(len(good)) {
+			t.Errorf("%s: got %d frames and %v, want the second frame to fail at %d", name, frames, ferr, len(good))
+		}
+	}
+
+	if _, err := Validate(bytes.NewReader(nil)); err != nil {
+		t.Errorf("empty file: %v", err)
+	}
+
+	dw, _ := NewWriter(ioutil.Discard, nil)
+	if err := dw.WriteFrame(nil); err != ErrBadLength {
+		t.Errorf("empty frame: got %v, want ErrBadLength", err)
+	}
+	if err := dw.WriteFrame(make([]byte, MaxFrameSize+1)); err != ErrBadLength {
+		t.Errorf("huge frame: got %v, want ErrBadLength", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	meta := &Metadata{
+		DCA:    ToolInfo{Version: 1, Tool: "test"},
+		Info:   SongInfo{Title: "a song"},
+		Origin: Origin{Source: "file", URL: "http://example.com"},
+		Extra:  Extra{Creator: "someone"},
+	}
+	meta.SetDuration(3)
+
+	var out bytes.Buffer
+	dw, err := NewWriter(&out, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		dw.WriteFrame([]byte{0xf8, 0xff, 0xfe})
+	}
+
+	frames, dr, err := readAll(t, out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 3 {
+		t.Errorf("got %d frames, want 3", len(frames))
+	}
+	if dr.Metadata == nil || *dr.Metadata != *meta {
+		t.Errorf("got metadata %+v, want %+v", dr.Metadata, meta)
+	}
+	if dr.Metadata.Duration() != Duration(3) {
+		t.Errorf("got duration %v, want %v", dr.Metadata.Duration(), Duration(3))
+	}
+	if dr.Offset() != int64(out.Len()) {
+		t.Errorf("offset %d, want %d", dr.Offset(), out.Len())
+	}
+
+	if _, err = NewReader(bytes.NewReader([]byte(Magic + "\xff\xff\xff\xff"))); err == nil {
+		t.Error("negative metadata size was accepted")
+	}
+	if _, err = NewReader(bytes.NewReader([]byte(Magic + "\x10\x00\x00\x00{}"))); err == nil {
+		t.Error("truncated metadata was accepted")
+	}
+}
+
+// Mangles the shipped files at random and makes sure reading them never
+// does anything worse than return an error. go-fuzz can take this further
+// with Fuzz.
+func TestFuzzAudioFiles(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for name, data := range seedFiles(t) {
+		for i := 0; i < 100; i++ {
+			mangled := append([]byte{}, data...)
+			switch rng.Intn(4) {
+			case 0:
+				// Flip some bytes
+				for j := 0; j < 1+rng.Intn(8); j++ {
+					mangled[rng.Intn(len(mangled))] ^= byte(1 + rng.Intn(255))
+				}
+			case 1:
+				// Cut it short
+				mangled = mangled[:rng.Intn(len(mangled))]
+			case 2:
+				// Stick a header on the front that may or may not make sense
+				header := []byte(Magic)
+				size := make([]byte, 4)
+				binary.LittleEndian.PutUint32(size, uint32(rng.Intn(64)))
+				header = append(header, size...)
+				mangled = append(header, mangled...)
+			case 3:
+				// Garbage in the middle
+				at := rng.Intn(len(mangled))
+				junk := make([]byte, 1+rng.Intn(16))
+				rng.Read(junk)
+				mangled = append(mangled[:at], append(junk, mangled[at:]...)...)
+			}
+
+			frames, dr, err := readAll(t, mangled)
+			if dr == nil {
+				continue
+			}
+			if err == nil && dr.Offset() != int64(len(mangled)) {
+				t.Fatalf("%s: clean end at %d of %d bytes", name, dr.Offset(), len(mangled))
+			}
+			// Validate also looks inside the packets, so it can only stop
+			// sooner
+			if n, _ := Validate(bytes.NewReader(mangled)); n > len(frames) {
+				t.Fatalf("%s: Validate counted %d frames, reader got %d", name, n, len(frames))
+			}
+
+			// Resync has to get to the end without going backwards
+			for err != nil {
+				before := dr.Offset()
+				if _, err = dr.Resync(); err != nil {
+					if err != io.EOF {
+						t.Fatalf("%s: resync: %v", name, err)
+					}
+					break
+				}
+				if dr.Offset() <= before || dr.Offset() > int64(len(mangled)) {
+					t.Fatalf("%s: resync went from %d to %d of %d bytes", name, before, dr.Offset(), len(mangled))
+				}
+				for err == nil {
+					_, err = dr.ReadFrame()
+				}
+				if err == io.EOF {
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestCheckPacket(t *testing.T) {
+	cases := []struct {
+		name   string
+		packet []byte
+		good   bool
+	}{
+		{"empty", nil, false},
+		{"one frame", []byte{0xfc, 1, 2, 3}, true},
+		{"one frame too long", append([]byte{0xfc}, make([]byte, maxOpusFrame+1)...), false},
+		{"two equal frames", []byte{0xfd, 1, 2, 3, 4}, true},
+		{"two equal frames odd", []byte{0xfd, 1, 2, 3}, false},
+		{"two frames", []byte{0xfe, 2, 1, 2, 3}, true},
+		{"two frames short", []byte{0xfe, 5, 1, 2}, false},
+		{"two frames no length", []byte{0xfe}, false},
+		{"cbr frames", []byte{0xff, 0x03, 1, 2, 3, 4, 5, 6}, true},
+		{"cbr frames uneven", []byte{0xff, 0x03, 1, 2, 3, 4}, false},
+		{"no frames", []byte{0xff, 0x00}, false},
+		{"over 120ms", []byte{0xff, 0x07, 1, 2, 3, 4, 5, 6, 7}, false},
+		{"vbr frames", []byte{0xff, 0x82, 1, 9, 8, 7}, true},
+		{"vbr frames short", []byte{0xff, 0x82, 5, 9}, false},
+		{"padded", []byte{0xff, 0x41, 2, 1, 0, 0}, true},
+		{"padding past the end", []byte{0xff, 0x41, 9, 1}, false},
+		{"padding never ends", []byte{0xff, 0x41, 255}, false},
+	}
+	for _, c := range cases {
+		if err := CheckPacket(c.packet); (err == nil) != c.good {
+			t.Errorf("%s: got %v, want good %v", c.name, err, c.good)
+		}
+	}
+}
+
+func TestResync(t *testing.T) {
+	var out bytes.Buffer
+	dw, _ := NewWriter(&out, nil)
+	dw.WriteFrame([]byte{0xfc, 1, 2})
+	out.Write([]byte{0xff, 0x7f, 0x00})
+	dw.WriteFrame([]byte{0xfc, 3, 4})
+	dw.WriteFrame([]byte{0xfc, 5, 6})
+
+	frames, dr, err := readAll(t, out.Bytes())
+	if len(frames) != 1 || err == nil {
+		t.Fatalf("got %d frames and %v, want one frame then an error", len(frames), err)
+	}
+	skipped, err := dr.Resync()
+	if err != nil || skipped != 3 {
+		t.Fatalf("resync skipped %d bytes with %v, want 3", skipped, err)
+	}
+	for _, want := range [][]byte{{0xfc, 3, 4}, {0xfc, 5, 6}} {
+		opus, err := dr.ReadFrame()
+		if err != nil || !bytes.Equal(opus, want) {
+			t.Fatalf("got %v %v after resync, want %v", opus, err, want)
+		}
+	}
+	if _, err = dr.ReadFrame(); err != io.EOF {
+		t.Errorf("got %v at the end, want io.EOF", err)
+	}
+}
+
+// Hands out one chunk per Read, failing with err once it gets to a nil chunk
+type chunkReader struct {
+	chunks [][]byte
+	err    error
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	chunk := r.chunks[0]
+	r.chunks = r.chunks[1:]
+	if chunk == nil {
+		return 0, r.err
+	}
+	return copy(p, chunk), nil
+}
+
+// A read failing part way through a frame still has the offset match what
+// was consumed once it picks back up
+func TestResyncPartialFrame(t *testing.T) {
+	var first, rest bytes.Buffer
+	dw, _ := NewWriter(&first, nil)
+	dw.WriteFrame([]byte{0xfc, 1, 2})
+	// Says 10 bytes but the read fails after 4 of them
+	first.Write([]byte{10, 0, 0xfc, 7, 7, 7})
+	dw, _ = NewWriter(&rest, nil)
+	dw.WriteFrame([]byte{0xfc, 3, 4})
+	dw.WriteFrame([]byte{0xfc, 5, 6})
+
+	readErr := errors.New("connection reset")
+	dr := NewRawReader(&chunkReader{chunks: [][]byte{first.Bytes(), nil, rest.Bytes()}, err: readErr})
+	if _, err := dr.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := dr.ReadFrame()
+	if ferr, ok := err.(*FrameError); !ok || ferr.Err != readErr || ferr.Offset != 5 {
+		t.Fatalf("got %v, want the read error at offset 5", err)
+	}
+
+	skipped, err := dr.Resync()
+	if err != nil || skipped != 6 || dr.Offset() != 11 {
+		t.Fatalf("resync skipped %d bytes to %d with %v, want 6 to 11", skipped, dr.Offset(), err)
+	}
+	for _, want := range [][]byte{{0xfc, 3, 4}, {0xfc, 5, 6}} {
+		opus, err := dr.ReadFrame()
+		if err != nil || !bytes.Equal(opus, want) {
+			t.Fatalf("got %v %v after resync, want %v", opus, err, want)
+		}
+	}
+	if dr.Offset() != 21 {
+		t.Errorf("ended at offset %d, want 21", dr.Offset())
+	}
+}
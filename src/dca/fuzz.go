@@ -0,0 +1,38 @@
+//go:build gofuzz
+// +build gofuzz
+
+package dca
+
+import (
+	"bytes"
+	"io"
+)
+
+// Fuzz - Entry point for go-fuzz, seed its corpus with the files in audio/
+func Fuzz(data []byte) int {
+	dr, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		return 0
+	}
+
+	var out bytes.Buffer
+	dw, _ := NewWriter(&out, nil)
+	for {
+		opus, err := dr.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0
+		}
+		if err = dw.WriteFrame(opus); err != nil {
+			panic("frame the reader took was refused by the writer")
+		}
+	}
+
+	// Everything good that was read has to come back out the same
+	if dr.Metadata == nil && !bytes.Equal(out.Bytes(), data) {
+		panic("frames changed on the way through")
+	}
+	return 1
+}
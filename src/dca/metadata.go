@@ -0,0 +1,124 @@
+package dca
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Magic - What DCA1 files start with
+const Magic = "DCA1"
+
+// Biggest metadata block we'll read, anything past this is a broken file
+const maxMetadataSize = 1 << 20
+
+// Metadata - The JSON block at the start of a DCA1 file. Follows the layout
+// of the dca spec, with what AirGoat needs on top in extra.
+type Metadata struct {
+	DCA    ToolInfo `json:"dca"`
+	Opus   OpusInfo `json:"opus"`
+	Info   SongInfo `json:"info"`
+	Origin Origin   `json:"origin"`
+	Extra  Extra    `json:"extra"`
+}
+
+// ToolInfo - Format version and what wrote the file
+type ToolInfo struct {
+	Version int    `json:"version"`
+	Tool    string `json:"tool"`
+}
+
+// OpusInfo - How the frames were encoded
+type OpusInfo struct {
+	Mode       string `json:"mode"`
+	SampleRate int    `json:"sample_rate"`
+	FrameSize  int    `json:"frame_size"`
+	Bitrate    int    `json:"abr"`
+	Channels   int    `json:"channels"`
+}
+
+// SongInfo - What the audio is
+type SongInfo struct {
+	Title string `json:"title"`
+}
+
+// Origin - Where the audio came from
+type Origin struct {
+	Source string `json:"source"`
+	URL    string `json:"url,omitempty"`
+}
+
+// Extra - Length in milliseconds, who made the file and which encoder was used
+type Extra struct {
+	Duration int64  `json:"duration"`
+	Creator  string `json:"creator,omitempty"`
+	Encoder  string `json:"encoder"`
+}
+
+// Duration - Length of the audio, 0 if the file didn't say
+func (m *Metadata) Duration() time.Duration {
+	return time.Duration(m.Extra.Duration) * time.Millisecond
+}
+
+// SetDuration - Records that the file holds frames frames
+func (m *Metadata) SetDuration(frames int) {
+	m.Extra.Duration = int64(Duration(frames) / time.Millisecond)
+}
+
+// Reads the DCA1 header off r if there is one, leaving r at the first frame.
+// Legacy files have no header and give back nil metadata. Returns how many
+// bytes the header took up.
+func readHeader(r *bufio.Reader) (*Metadata, int64, error) {
+	magic, err := r.Peek(len(Magic))
+	if err != nil || string(magic) != Magic {
+		// Too short for a header, or raw frames
+		return nil, 0, nil
+	}
+	r.Discard(len(Magic))
+
+	var size int32
+	if err = binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, 0, noEOF(err)
+	}
+	if size < 0 || size > maxMetadataSize {
+		return nil, 0, fmt.Errorf("dca: bad metadata size %d", size)
+	}
+
+	data := make([]byte, size)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return nil, 0, noEOF(err)
+	}
+
+	meta := &Metadata{}
+	if err = json.Unmarshal(data, meta); err != nil {
+		return nil, 0, fmt.Errorf("dca: bad metadata: %v", err)
+	}
+	return meta, int64(len(Magic)) + 4 + int64(size), nil
+}
+
+// WriteHeader - Writes the DCA1 magic and meta to w
+func WriteHeader(w io.Writer, meta *Metadata) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	var header bytes.Buffer
+	header.WriteString(Magic)
+	binary.Write(&header, binary.LittleEndian, int32(len(data)))
+	header.Write(data)
+	_, err = w.Write(header.Bytes())
+	return err
+}
+
+// A header cut short is a broken file, not an empty one
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package dca
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrBadPacket - A frame whose bytes can't be an Opus packet
+var ErrBadPacket = errors.New("dca: bad opus packet")
+
+const (
+	// Longest a single Opus frame inside a packet can be
+	maxOpusFrame = 1275
+
+	// Most audio one packet can hold
+	maxPacketDuration = 120 * time.Millisecond
+)
+
+// CheckPacket - Checks an Opus packet's TOC byte and frame lengths against
+// the rules in RFC 6716 section 3.4. Says nothing about whether the audio
+// inside decodes, only that the packet is put together right.
+func CheckPacket(packet []byte) error {
+	if len(packet) == 0 {
+		return ErrBadPacket
+	}
+	toc, data := packet[0], packet[1:]
+
+	switch toc & 3 {
+	case 0:
+		// One frame
+		if len(data) > maxOpusFrame {
+			return ErrBadPacket
+		}
+	case 1:
+		// Two frames the same size
+		if len(data)%2 != 0 || len(data)/2 > maxOpusFrame {
+			return ErrBadPacket
+		}
+	case 2:
+		// Two frames, the first one's length up front
+		n, size := frameLength(data)
+		if n == 0 || size > len(data)-n || len(data)-n-size > maxOpusFrame {
+			return ErrBadPacket
+		}
+	case 3:
+		// Any number of frames, with a count byte and maybe padding
+		if len(data) == 0 {
+			return ErrBadPacket
+		}
+		count := int(data[0] & 0x3f)
+		vbr := data[0]&0x80 != 0
+		padded := data[0]&0x40 != 0
+		data = data[1:]
+		if count == 0 || time.Duration(count)*frameDuration(toc) > maxPacketDuration {
+			return ErrBadPacket
+		}
+
+		if padded {
+			padding := 0
+			for {
+				if len(data) == 0 {
+					return ErrBadPacket
+				}
+				p := int(data[0])
+				data = data[1:]
+				if p < 255 {
+					padding += p
+					break
+				}
+				padding += 254
+			}
+			if padding > len(data) {
+				return ErrBadPacket
+			}
+			data = data[:len(data)-padding]
+		}
+
+		if vbr {
+			// Every frame but the last has its length up front
+			total := 0
+			for i := 0; i < count-1; i++ {
+				n, size := frameLength(data)
+				if n == 0 {
+					return ErrBadPacket
+				}
+				data = data[n:]
+				total += size
+			}
+			if total > len(data) || len(data)-total > maxOpusFrame {
+				return ErrBadPacket
+			}
+		} else if len(data)%count != 0 || len(data)/count > maxOpusFrame {
+			return ErrBadPacket
+		}
+	}
+	return nil
+}
+
+// Reads a frame length coded in one or two bytes, returning how many bytes
+// it took up. 0 if data is too short to hold one.
+func frameLength(data []byte) (int, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	if data[0] < 252 {
+		return 1, int(data[0])
+	}
+	if len(data) < 2 {
+		return 0, 0
+	}
+	return 2, int(data[0]) + 4*int(data[1])
+}
+
+// How much audio each frame in a packet with this TOC byte holds
+func frameDuration(toc byte) time.Duration {
+	config := toc >> 3
+	switch {
+	case config < 12:
+		// SILK
+		return [...]time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16:
+		// Hybrid
+		return [...]time.Duration{10, 20}[config%2] * time.Millisecond
+	default:
+		// CELT
+		return [...]time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+	}
+}
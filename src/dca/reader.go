@@ -0,0 +1,177 @@
+package dca
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// Enough buffer to look at a whole frame and the length of the next one
+// without consuming either
+const readBufferSize = 16384
+
+// Reader - Streams frames out of a DCA file
+type Reader struct {
+	// Metadata from the DCA1 header, nil for legacy files
+	Metadata *Metadata
+
+	r      *bufio.Reader
+	offset int64
+	frames int
+	err    error
+
+	// How much of a frame cut short was read before it failed, past offset
+	consumed int64
+}
+
+// NewReader - Reads the header off r, if it has one, and gets ready to read
+// frames
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReaderSize(r, readBufferSize)
+
+	meta, size, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		Metadata: meta,
+		r:        br,
+		offset:   size,
+	}, nil
+}
+
+// NewRawReader - Reads frames from r without looking for a header first, for
+// streams that never have one like an encoder's output. Unlike NewReader it
+// doesn't block waiting for the first bytes.
+func NewRawReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, readBufferSize)}
+}
+
+// ReadFrame - The next opus frame. Returns io.EOF once the file ends cleanly
+// after a frame, and a *FrameError if it ends part way through one or a
+// length prefix is corrupt. Errors stick until Resync.
+func (dr *Reader) ReadFrame() ([]byte, error) {
+	size, err := dr.next()
+	if err != nil {
+		return nil, err
+	}
+
+	opus := make([]byte, size)
+	dr.r.Discard(2)
+	if n, err := io.ReadFull(dr.r, opus); err != nil {
+		dr.consumed = 2 + int64(n)
+		return nil, dr.fail(noEOF(err))
+	}
+	dr.advance(size)
+	return opus, nil
+}
+
+// Skip - Steps over the next frame without reading it, returning its size.
+// Errors the same way ReadFrame does.
+func (dr *Reader) Skip() (int, error) {
+	size, err := dr.next()
+	if err != nil {
+		return 0, err
+	}
+
+	if n, err := dr.r.Discard(2 + size); err != nil {
+		dr.consumed = int64(n)
+		return 0, dr.fail(noEOF(err))
+	}
+	dr.advance(size)
+	return size, nil
+}
+
+// Resync - After a *FrameError, steps forward a byte at a time until it finds
+// what looks like a good frame followed by another or the end of the file,
+// so reading can carry on past the damage. Returns how many bytes were
+// skipped, or io.EOF if nothing good comes after.
+func (dr *Reader) Resync() (int64, error) {
+	if _, ok := dr.err.(*FrameError); !ok {
+		return 0, dr.err
+	}
+
+	// A frame cut short was read into already, which counts as skipped and
+	// might have left us right at the next good one
+	skipped := dr.consumed
+	dr.consumed = 0
+	for skipped == 0 || !dr.plausible() {
+		if _, err := dr.r.Discard(1); err != nil {
+			dr.err = err
+			return skipped, err
+		}
+		skipped++
+	}
+	dr.err = nil
+	dr.offset += skipped
+	return skipped, nil
+}
+
+// Frames - How many good frames have been read so far
+func (dr *Reader) Frames() int {
+	return dr.frames
+}
+
+// Offset - Where the next frame starts, which is also how much of the file
+// is known good
+func (dr *Reader) Offset() int64 {
+	return dr.offset
+}
+
+// Checks the next length prefix without consuming it
+func (dr *Reader) next() (int, error) {
+	if dr.err != nil {
+		return 0, dr.err
+	}
+
+	prefix, err := dr.r.Peek(2)
+	if err == io.EOF && len(prefix) == 0 {
+		dr.err = io.EOF
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, dr.fail(noEOF(err))
+	}
+	size := int16(binary.LittleEndian.Uint16(prefix))
+	if size <= 0 || size > MaxFrameSize {
+		return 0, dr.fail(ErrBadLength)
+	}
+	return int(size), nil
+}
+
+// True if the bytes coming up are a sane length prefix and opus packet, with
+// the end of the file or another sane length prefix after them
+func (dr *Reader) plausible() bool {
+	prefix, err := dr.r.Peek(2)
+	if err != nil {
+		return false
+	}
+	size := int(int16(binary.LittleEndian.Uint16(prefix)))
+	if size <= 0 || size > MaxFrameSize {
+		return false
+	}
+
+	frame, err := dr.r.Peek(2 + size + 2)
+	if len(frame) < 2+size {
+		return false
+	}
+	if CheckPacket(frame[2:2+size]) != nil {
+		return false
+	}
+	if err != nil {
+		// Nothing after it but the end of the file
+		return len(frame) == 2+size
+	}
+	nextSize := int16(binary.LittleEndian.Uint16(frame[2+size:]))
+	return nextSize > 0 && nextSize <= MaxFrameSize
+}
+
+func (dr *Reader) advance(size int) {
+	dr.offset += 2 + int64(size)
+	dr.frames++
+}
+
+func (dr *Reader) fail(err error) error {
+	dr.err = &FrameError{Frame: dr.frames, Offset: dr.offset, Err: err}
+	return dr.err
+}
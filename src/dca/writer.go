@@ -0,0 +1,46 @@
+package dca
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Writer - Writes frames out in DCA format
+type Writer struct {
+	w      io.Writer
+	frames int
+}
+
+// NewWriter - Starts a DCA file on w. With meta it's a DCA1 file, without it
+// a legacy raw one.
+func NewWriter(w io.Writer, meta *Metadata) (*Writer, error) {
+	if meta != nil {
+		if err := WriteHeader(w, meta); err != nil {
+			return nil, err
+		}
+	}
+	return &Writer{w: w}, nil
+}
+
+// WriteFrame - Writes one opus frame with its length prefix. Frames no reader
+// would accept are refused with ErrBadLength.
+func (dw *Writer) WriteFrame(opus []byte) error {
+	if len(opus) == 0 || len(opus) > MaxFrameSize {
+		return ErrBadLength
+	}
+
+	// One write per frame, so frames never get split on unbuffered writers
+	frame := make([]byte, 2+len(opus))
+	binary.LittleEndian.PutUint16(frame, uint16(len(opus)))
+	copy(frame[2:], opus)
+	if _, err := dw.w.Write(frame); err != nil {
+		return err
+	}
+	dw.frames++
+	return nil
+}
+
+// Frames - How many frames have been written
+func (dw *Writer) Frames() int {
+	return dw.frames
+}